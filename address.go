@@ -0,0 +1,143 @@
+package selfup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseAddress splits a Config.Addresses entry into its network and
+// address. Addresses without a scheme, like ":3000", are TCP.
+func parseAddress(s string) (network, addr string, err error) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return "tcp", s, nil
+	}
+	network, addr = s[:i], s[i+3:]
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix", "unixgram":
+	default:
+		return "", "", fmt.Errorf("unsupported network %q", network)
+	}
+	if addr == "" {
+		return "", "", fmt.Errorf("missing %s address", network)
+	}
+	return network, addr, nil
+}
+
+// isPacketNetwork is true for datagram networks,
+// which are passed to the program as net.PacketConns
+func isPacketNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+// socketPerms applies the configured mode,
+// owner and group to a unix socket file
+func (mp *master) socketPerms(path string) error {
+	if mp.Config.SocketMode != 0 {
+		if err := os.Chmod(path, mp.Config.SocketMode); err != nil {
+			return err
+		}
+	}
+	if mp.Config.SocketOwner == "" && mp.Config.SocketGroup == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if o := mp.Config.SocketOwner; o != "" {
+		id := o
+		if _, err := strconv.Atoi(o); err != nil {
+			u, err := user.Lookup(o)
+			if err != nil {
+				return err
+			}
+			id = u.Uid
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+	if g := mp.Config.SocketGroup; g != "" {
+		id := g
+		if _, err := strconv.Atoi(g); err != nil {
+			grp, err := user.LookupGroup(g)
+			if err != nil {
+				return err
+			}
+			id = grp.Gid
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// socketSpec is a named entry of Config.Addresses
+// or Config.NamedAddresses
+type socketSpec struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// socketSpecs lists the sockets of the config, Addresses in order
+// (named by their address) followed by NamedAddresses sorted by name
+func (c *Config) socketSpecs() []socketSpec {
+	specs := []socketSpec{}
+	for _, addr := range c.Addresses {
+		specs = append(specs, socketSpec{Name: addr, Address: addr})
+	}
+	names := make([]string, 0, len(c.NamedAddresses))
+	for name := range c.NamedAddresses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		specs = append(specs, socketSpec{Name: name, Address: c.NamedAddresses[name]})
+	}
+	return specs
+}
+
+func sameSockets(a, b []socketSpec) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// the sanity check of a binary includes its sockets,
+// so the master can open them before it is started
+const sanitySocketsPrefix = "selfup-sockets:"
+
+func printSanitySockets(c *Config) {
+	b, _ := json.Marshal(c.socketSpecs())
+	fmt.Fprintf(os.Stdout, "\n%s%s\n", sanitySocketsPrefix, b)
+}
+
+// parseSanitySockets returns the sockets in the output of
+// a sanity check, ok is false if the binary didn't list them
+func parseSanitySockets(out []byte) (specs []socketSpec, ok bool) {
+	for _, line := range strings.Split(string(out), "\n") {
+		if s := strings.TrimPrefix(line, sanitySocketsPrefix); s != line {
+			if err := json.Unmarshal([]byte(s), &specs); err != nil {
+				return nil, false
+			}
+			return specs, true
+		}
+	}
+	return nil, false
+}
+
+// fdInfo describes each descriptor passed to a slave
+type fdInfo struct {
+	socketSpec
+	Network string `json:"network"`
+}
@@ -0,0 +1,87 @@
+package selfup
+
+//a canary runs a fetched binary alongside the current program,
+//on the same sockets, before the binary is installed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runCanary runs the temp binary as a canary for Config.Canary,
+// returning an error if it should not be installed
+func (mp *master) runCanary(digest, version string) error {
+	s := &slaveProcess{canary: true}
+	mp.restartMux.Lock()
+	err := mp.startProcess(s, tmpBinPath, digest)
+	mp.restartMux.Unlock()
+	if err != nil {
+		return err
+	}
+	mp.canary.Store(s)
+	defer mp.canary.Store(nil)
+	defer mp.stopCanary(s)
+	pid := s.cmd.Process.Pid
+	mslog.Info("running canary", "new-bin-hash", digest, "new-version", version, "pid", pid, "canary", mp.Canary)
+	mp.emit(CanaryStartedEvent{Hash: digest, Version: version, SlaveID: s.id, PID: pid})
+	if mp.ReadyTimeout > 0 {
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return fmt.Errorf("exited with code %d before becoming ready", exitCode(s.err))
+		case <-time.After(mp.ReadyTimeout):
+			return errors.New("not ready in time")
+		}
+	}
+	select {
+	case <-s.done:
+		return fmt.Errorf("exited with code %d", exitCode(s.err))
+	case <-time.After(mp.Canary):
+	}
+	if mp.CanaryCheck != nil {
+		if err := mp.CanaryCheck(pid); err != nil {
+			return fmt.Errorf("check failed: %s", err)
+		}
+	}
+	if s.exited() {
+		return fmt.Errorf("exited with code %d", exitCode(s.err))
+	}
+	mslog.Info("canary passed", "new-bin-hash", digest)
+	mp.emit(CanaryPassedEvent{Hash: digest, Version: version})
+	return nil
+}
+
+// stopCanary gracefully stops a canary, it's
+// killed if it doesn't exit within TerminateTimeout
+func (mp *master) stopCanary(s *slaveProcess) {
+	if s.exited() {
+		return
+	}
+	s.stopping.Store(true)
+	s.cmd.Process.Signal(mp.Config.RestartSignal)
+	select {
+	case <-s.done:
+	case <-time.After(mp.TerminateTimeout):
+		mslog.Debug("canary graceful timeout, forcing exit")
+		s.cmd.Process.Kill()
+		<-s.done
+	}
+}
+
+// signalCanary proxies a signal to the running canary, if any
+func (mp *master) signalCanary(sig os.Signal) {
+	if s := mp.canary.Load(); s != nil && !s.exited() {
+		s.stopping.Store(true)
+		s.cmd.Process.Signal(sig)
+	}
+}
+
+// refuseCanary remembers the hash of a failed canary
+// so it won't be run or installed again
+func (mp *master) refuseCanary(digest string) {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	mp.badHashes[digest] = true
+}
@@ -0,0 +1,168 @@
+// Command selfup-sign generates signing keys and signs
+// binaries for use with verifier.Ed25519.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rainkfun/selfup/fetcher"
+	"github.com/rainkfun/selfup/verifier"
+)
+
+const usage = `Usage: selfup-sign <command> [options]
+
+Commands:
+  keygen [-out selfup.key]            write a new private key and its .pub public key
+  sign -key selfup.key <binary>...    write a detached <binary>.sig for each binary
+  verify -pub selfup.key.pub <binary> check <binary>.sig against the public key
+
+Compressed binaries and archives (such as myapp.gz or myapp.tar.gz)
+are signed and verified by the binary they contain, which is what
+the fetchers verify. -entry names the binary in archives, it defaults
+to the name of the archive without its extensions.
+
+The public key is used with:
+  selfup.Config{Verifier: &verifier.Ed25519{PublicKey: "..."}}
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "keygen":
+		err = keygen(args)
+	case "sign":
+		err = sign(args)
+	case "verify":
+		err = verify(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "selfup-sign: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "selfup.key", "private key path, the public key is written to <out>.pub")
+	fs.Parse(args)
+	pub, priv, err := verifier.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, []byte(priv+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out+".pub", []byte(pub+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Println(pub)
+	return nil
+}
+
+func sign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := fs.String("key", "selfup.key", "private key path")
+	entry := fs.String("entry", "", "binary in archives, defaults to the archive name without extensions")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no binaries to sign")
+	}
+	key, err := os.ReadFile(*keyPath)
+	if err != nil {
+		return err
+	}
+	for _, bin := range fs.Args() {
+		sig, err := withBinary(bin, *entry, func(binPath string) ([]byte, error) {
+			return verifier.Sign(string(key), binPath)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %s", bin, err)
+		}
+		if err := os.WriteFile(bin+".sig", sig, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("signed %s\n", bin)
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	pubPath := fs.String("pub", "selfup.key.pub", "public key path")
+	entry := fs.String("entry", "", "binary in archives, defaults to the archive name without extensions")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected one binary to verify")
+	}
+	pub, err := os.ReadFile(*pubPath)
+	if err != nil {
+		return err
+	}
+	bin := fs.Arg(0)
+	sig, err := os.ReadFile(bin + ".sig")
+	if err != nil {
+		return err
+	}
+	v := &verifier.Ed25519{PublicKey: strings.TrimSpace(string(pub))}
+	_, err = withBinary(bin, *entry, func(binPath string) ([]byte, error) {
+		return nil, v.Verify(binPath, sig)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %s", bin, err)
+	}
+	fmt.Printf("verified %s\n", bin)
+	return nil
+}
+
+// archive and compression extensions, trimmed to find the entry
+var extensions = []string{".gz", ".tgz", ".bz2", ".tbz2", ".xz", ".txz", ".zst", ".tzst", ".tar", ".zip"}
+
+// withBinary calls fn with the path of the binary in the asset, like
+// the fetchers it's decompressed and extracted to a temp file first
+func withBinary(asset, entry string, fn func(binPath string) ([]byte, error)) ([]byte, error) {
+	if entry == "" {
+		entry = filepath.Base(asset)
+		for trimmed := true; trimmed; {
+			trimmed = false
+			for _, ext := range extensions {
+				if e := strings.TrimSuffix(entry, ext); e != entry && e != "" {
+					entry, trimmed = e, true
+				}
+			}
+		}
+	}
+	f, err := os.Open(asset)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fetcher.Decode(f, asset, entry)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	tmp, err := os.CreateTemp("", "selfup-sign-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fn(tmp.Name())
+}
@@ -0,0 +1,201 @@
+package selfup
+
+//the control socket lets operators query and
+//command a running master process, see package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rainkfun/selfup/control"
+)
+
+func (mp *master) serveControl() error {
+	path := mp.Config.ControlSocket
+	if err := removeStaleSocket("unix", path); err != nil {
+		return fmt.Errorf("control socket %s (%s)", path, err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("control socket %s (%s)", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("control socket %s (%s)", path, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				mslog.Warn("control socket closed", "err", err)
+				return
+			}
+			go mp.handleControl(conn)
+		}
+	}()
+	return nil
+}
+
+// removeStaleSocket removes a unix socket file which
+// was left behind by a process which has since exited
+func removeStaleSocket(network, path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New("file exists and is not a socket")
+	}
+	if conn, err := net.DialTimeout(network, path, time.Second); err == nil {
+		conn.Close()
+		return errors.New("socket is in use")
+	}
+	return os.Remove(path)
+}
+
+func (mp *master) handleControl(conn net.Conn) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		resp := mp.control(cmd)
+		mslog.Debug("control command", "command", cmd, "ok", resp.OK)
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (mp *master) control(line string) control.Response {
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case control.CommandStatus:
+		status := mp.status()
+		return control.Response{OK: true, Status: &status}
+	case control.CommandMetrics:
+		return control.Response{OK: true, Metrics: mp.metricsText()}
+	case control.CommandRestart:
+		if mp.currentSlave() == nil {
+			return control.Response{Error: "no slave process"}
+		}
+		go mp.triggerRestart()
+	case control.CommandCheckNow:
+		if mp.Config.Fetcher == nil {
+			return control.Response{Error: "no fetcher"}
+		}
+		if mp.updatesPaused() {
+			return control.Response{Error: "updates are paused"}
+		}
+		select {
+		case mp.checkNow <- true:
+		default: //already scheduled
+		}
+	case control.CommandPauseUpdates:
+		mp.setUpdatesPaused(true)
+	case control.CommandResumeUpdates:
+		mp.setUpdatesPaused(false)
+	case control.CommandHistory:
+		return control.Response{OK: true, History: mp.binaryHistory()}
+	case control.CommandRollback:
+		n, err := strconv.Atoi(strings.TrimSpace(arg))
+		if err != nil {
+			return control.Response{Error: "usage: rollback <upgrades ago>"}
+		}
+		if err := mp.rollbackTo(n); err != nil {
+			return control.Response{Error: err.Error()}
+		}
+	default:
+		return control.Response{Error: "unknown command: " + cmd}
+	}
+	return control.Response{OK: true}
+}
+
+func (mp *master) status() control.Status {
+	s := control.Status{
+		PID:       os.Getpid(),
+		StartedAt: mp.startedAt,
+	}
+	mp.upgradeMux.Lock()
+	s.BinHash = mp.binHash
+	s.BinVersion = mp.binVersion
+	mp.upgradeMux.Unlock()
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	if sp := mp.slave; sp != nil && sp.cmd.Process != nil && !sp.exited() {
+		s.SlavePID = sp.cmd.Process.Pid
+		s.SlaveID = sp.id
+		s.SlaveStartedAt = sp.startedAt
+	}
+	for _, w := range mp.workers {
+		if w != nil && w.cmd.Process != nil && !w.exited() {
+			s.WorkerPIDs = append(s.WorkerPIDs, w.cmd.Process.Pid)
+		}
+	}
+	s.Restarts = mp.restarts
+	s.CrashRestarts = mp.supervisor.restarts
+	s.LastExitCode = mp.supervisor.lastExitCode
+	s.UpdatesPaused = mp.paused
+	if f := mp.lastFetch; f != nil {
+		copied := *f
+		s.LastFetch = &copied
+	}
+	return s
+}
+
+func (mp *master) setUpdatesPaused(paused bool) {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	if mp.paused != paused {
+		mslog.Info("updates paused", "paused", paused)
+	}
+	mp.paused = paused
+}
+
+func (mp *master) updatesPaused() bool {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	return mp.paused
+}
+
+func (mp *master) recordFetch(result, reason string) {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	mp.lastFetch = &control.Fetch{
+		At:     time.Now(),
+		Result: result,
+		Error:  reason,
+	}
+}
+
+// fetchFailed logs and records why the last fetch did not upgrade
+func (mp *master) fetchFailed(e Event, msg string, args ...any) {
+	mslog.Warn(msg, args...)
+	mp.emit(e)
+	result := control.FetchFailed
+	switch e.(type) {
+	case UpgradeRefusedEvent, SanityCheckFailedEvent:
+		result = control.FetchSkipped
+	}
+	reason := msg
+	for i := 0; i+1 < len(args); i += 2 {
+		v := args[i+1]
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		reason += fmt.Sprintf(" %v=%v", args[i], v)
+	}
+	mp.recordFetch(result, reason)
+}
@@ -0,0 +1,209 @@
+// Package control is a client for the control socket
+// served by a selfup master process (Config.ControlSocket).
+//
+// The protocol is line based, each command is written as a
+// single line and answered with a single line of JSON (see
+// Response), so the socket can also be used from the shell:
+//
+//	echo status | nc -U /run/myapp.sock
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Commands accepted by the control socket
+const (
+	//CommandStatus responds with the Status of the master
+	CommandStatus = "status"
+	//CommandRestart triggers a graceful restart
+	CommandRestart = "restart"
+	//CommandCheckNow checks for updates without waiting for the interval.
+	//Fetchers which sleep in Fetch, rather than implementing
+	//fetcher.ContextInterface, still check once their sleep ends.
+	CommandCheckNow = "check-now"
+	//CommandPauseUpdates stops checking for and installing updates
+	CommandPauseUpdates = "pause-updates"
+	//CommandResumeUpdates undoes CommandPauseUpdates
+	CommandResumeUpdates = "resume-updates"
+	//CommandMetrics responds with the master's metrics
+	//in the Prometheus text format
+	CommandMetrics = "metrics"
+	//CommandHistory responds with the stored binaries, newest first
+	CommandHistory = "history"
+	//CommandRollback reinstalls a stored binary and restarts the
+	//program, it takes the number of upgrades ago: "rollback 1"
+	CommandRollback = "rollback"
+)
+
+// Results of a fetch
+const (
+	FetchNoUpdate = "no-update"
+	FetchUpgraded = "upgraded"
+	FetchSkipped  = "skipped"
+	FetchFailed   = "failed"
+)
+
+// Response to a command
+type Response struct {
+	OK     bool    `json:"ok"`
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+	//Metrics in the Prometheus text format
+	Metrics string `json:"metrics,omitempty"`
+	//History of binaries, newest first
+	History []Binary `json:"history,omitempty"`
+}
+
+// Status of a master process and its program
+type Status struct {
+	//PID of the master process
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+	//SlavePID is the process running the program, 0 if none
+	SlavePID       int       `json:"slave_pid"`
+	SlaveID        int       `json:"slave_id"`
+	SlaveStartedAt time.Time `json:"slave_started_at"`
+	//WorkerPIDs are the processes running each worker, with Config.Workers
+	WorkerPIDs []int `json:"worker_pids,omitempty"`
+	//BinHash and BinVersion describe the installed binary
+	BinHash    string `json:"bin_hash"`
+	BinVersion string `json:"bin_version,omitempty"`
+	//Restarts counts how many times the program has been restarted
+	Restarts int `json:"restarts"`
+	//CrashRestarts counts restarts made by the restart policy after
+	//the program exited unexpectedly, LastExitCode caused the last one
+	CrashRestarts int    `json:"crash_restarts"`
+	LastExitCode  int    `json:"last_exit_code"`
+	UpdatesPaused bool   `json:"updates_paused"`
+	LastFetch     *Fetch `json:"last_fetch,omitempty"`
+}
+
+// Uptime of the program
+func (s *Status) Uptime() time.Duration {
+	if s.SlaveStartedAt.IsZero() {
+		return 0
+	}
+	return time.Since(s.SlaveStartedAt)
+}
+
+// Binary is an entry in the history of installed binaries
+type Binary struct {
+	Hash        string    `json:"hash"`
+	Version     string    `json:"version,omitempty"`
+	InstalledAt time.Time `json:"installed_at"`
+	//Source of the binary, the fetcher type, "rollback" or "initial"
+	Source string `json:"source,omitempty"`
+}
+
+// Fetch describes the result of a check for updates
+type Fetch struct {
+	At     time.Time `json:"at"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Client sends commands to the control socket of a master process
+type Client struct {
+	//Path of the master's Config.ControlSocket
+	Path string
+	//Timeout of each command, defaults to 5 seconds
+	Timeout time.Duration
+}
+
+// Do sends a command and returns its response,
+// an unsuccessful response is returned as an error
+func (c *Client) Do(command string) (*Response, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	conn, err := net.DialTimeout("unix", c.Path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	resp := &Response{}
+	if err := json.Unmarshal(line, resp); err != nil {
+		return nil, fmt.Errorf("invalid response (%s)", err)
+	}
+	if !resp.OK {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Status of the master process
+func (c *Client) Status() (*Status, error) {
+	resp, err := c.Do(CommandStatus)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return nil, errors.New("missing status")
+	}
+	return resp.Status, nil
+}
+
+// Restart the program gracefully
+func (c *Client) Restart() error {
+	_, err := c.Do(CommandRestart)
+	return err
+}
+
+// CheckNow checks for updates immediately
+func (c *Client) CheckNow() error {
+	_, err := c.Do(CommandCheckNow)
+	return err
+}
+
+// PauseUpdates stops checking for updates until ResumeUpdates
+func (c *Client) PauseUpdates() error {
+	_, err := c.Do(CommandPauseUpdates)
+	return err
+}
+
+// ResumeUpdates undoes PauseUpdates
+func (c *Client) ResumeUpdates() error {
+	_, err := c.Do(CommandResumeUpdates)
+	return err
+}
+
+// Metrics of the master process in the Prometheus text format
+func (c *Client) Metrics() (string, error) {
+	resp, err := c.Do(CommandMetrics)
+	if err != nil {
+		return "", err
+	}
+	return resp.Metrics, nil
+}
+
+// History lists the stored binaries, the first
+// is the installed binary followed by previous ones
+func (c *Client) History() ([]Binary, error) {
+	resp, err := c.Do(CommandHistory)
+	if err != nil {
+		return nil, err
+	}
+	return resp.History, nil
+}
+
+// Rollback reinstalls the binary installed n upgrades ago
+// and gracefully restarts the program
+func (c *Client) Rollback(n int) error {
+	_, err := c.Do(fmt.Sprintf("%s %d", CommandRollback, n))
+	return err
+}
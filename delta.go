@@ -0,0 +1,74 @@
+package selfup
+
+//fetchers can stream a patch of the running binary rather than
+//the binary, the master applies it falling back to the full binary
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/kr/binarydist"
+	"github.com/rainkfun/selfup/fetcher"
+)
+
+// download writes the fetched binary to tmpBin, returning its size.
+// A patch is applied to the running binary and if that fails, the
+// full binary is fetched instead.
+func (mp *master) download(reader io.Reader, tmpBin *os.File, h hash.Hash64) (int64, error) {
+	p, ok := reader.(fetcher.Patched)
+	if !ok || p.PatchHash() == "" {
+		return io.Copy(tmpBin, io.TeeReader(reader, h))
+	}
+	n, err := mp.applyPatch(reader, p.PatchHash(), tmpBin, h)
+	if err == nil || mp.fetchCtx.Err() != nil {
+		return n, err
+	}
+	mslog.Warn("failed to apply patch, fetching the full binary", "err", err)
+	if _, err := tmpBin.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := tmpBin.Truncate(0); err != nil {
+		return 0, err
+	}
+	h.Reset()
+	full, err := p.Full()
+	if err != nil {
+		return 0, err
+	}
+	if closer, ok := full.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return io.Copy(tmpBin, io.TeeReader(full, h))
+}
+
+// applyPatch patches the running binary into tmpBin, the
+// result must have the hash the patch was made for
+func (mp *master) applyPatch(patch io.Reader, patchHash string, tmpBin *os.File, h hash.Hash64) (int64, error) {
+	old, err := os.Open(mp.binPath)
+	if err != nil {
+		return 0, err
+	}
+	defer old.Close()
+	w := &countWriter{w: io.MultiWriter(tmpBin, h)}
+	if err := binarydist.Patch(old, w, patch); err != nil {
+		return 0, fmt.Errorf("invalid patch (%s)", err)
+	}
+	if digest := fmt.Sprintf("%x", h.Sum64()); digest != patchHash {
+		return 0, fmt.Errorf("patched binary hash %s does not match %s", digest, patchHash)
+	}
+	mslog.Debug("applied patch", "bin-hash", mp.binHash, "new-bin-hash", patchHash)
+	return w.n, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,62 @@
+package selfup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rainkfun/go-kit/hash"
+	"github.com/rainkfun/selfup/fetcher"
+)
+
+// TestDownloadPatch applies a patch made with fetcher.Diff, a patched
+// binary without the expected hash is replaced by the full binary
+func TestDownloadPatch(t *testing.T) {
+	old := bytes.Repeat([]byte("selfup binary v1\n"), 100)
+	new := bytes.Repeat([]byte("selfup binary v2\n"), 100)
+	patch := &bytes.Buffer{}
+	if err := fetcher.Diff(bytes.NewReader(old), bytes.NewReader(new), patch); err != nil {
+		t.Skipf("diff failed (%s)", err)
+	}
+	h := hash.NewXXH64()
+	h.Write(new)
+	newHash := fmt.Sprintf("%x", h.Sum64())
+	dir := t.TempDir()
+	mp := &master{binPath: filepath.Join(dir, "bin")}
+	mp.fetchCtx, mp.stopFetching = context.WithCancel(context.Background())
+	if err := os.WriteFile(mp.binPath, old, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, patchHash := range []string{newHash, "0123456789abcdef"} {
+		fetchedFull := false
+		full := func() (io.Reader, error) {
+			fetchedFull = true
+			return bytes.NewReader(new), nil
+		}
+		r := fetcher.WithPatch(bytes.NewReader(patch.Bytes()), patchHash, full)
+		tmpBin, err := os.Create(filepath.Join(dir, "tmp-"+patchHash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := hash.NewXXH64()
+		n, err := mp.download(r, tmpBin, h)
+		tmpBin.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := os.ReadFile(tmpBin.Name())
+		if n != int64(len(new)) || !bytes.Equal(b, new) {
+			t.Fatalf("downloaded %d bytes, want the %d bytes of the new binary", n, len(new))
+		}
+		if digest := fmt.Sprintf("%x", h.Sum64()); digest != newHash {
+			t.Fatalf("hash %s, want %s", digest, newHash)
+		}
+		if mismatch := patchHash != newHash; fetchedFull != mismatch {
+			t.Fatalf("fetched the full binary %v, want %v", fetchedFull, mismatch)
+		}
+	}
+}
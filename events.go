@@ -0,0 +1,231 @@
+package selfup
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is a lifecycle event of the master process, passed to
+// Config.OnEvent. Use a type switch to inspect its details:
+//
+//	OnEvent: func(e selfup.Event) {
+//		switch e := e.(type) {
+//		case selfup.BinaryReplacedEvent:
+//			notify("upgraded to " + e.Version)
+//		case selfup.RolledBackEvent:
+//			notify("rolled back: " + e.Reason)
+//		}
+//	}
+type Event interface {
+	//Kind is a short name of the event, for example "binary-replaced"
+	Kind() string
+}
+
+// FetchStartedEvent is emitted before each check for updates
+type FetchStartedEvent struct{}
+
+// NoUpdateEvent is emitted when a check found no new binary
+type NoUpdateEvent struct{}
+
+// FetchFailedEvent is emitted when a check for updates, or
+// streaming and installing the new binary, fails
+type FetchFailedEvent struct {
+	Err error
+}
+
+// DownloadFinishedEvent is emitted once a new binary
+// has been streamed to a temporary file
+type DownloadFinishedEvent struct {
+	Hash     string
+	Version  string
+	Bytes    int64
+	Duration time.Duration
+}
+
+// UpgradeRefusedEvent is emitted when a downloaded binary will not be
+// installed, for example it is a downgrade, it was previously rolled
+// back, its signature is invalid or PreUpgrade returned an error
+type UpgradeRefusedEvent struct {
+	Hash    string
+	Version string
+	Reason  string
+}
+
+// SanityCheckFailedEvent is emitted when a downloaded
+// binary fails to run or isn't a selfup program
+type SanityCheckFailedEvent struct {
+	Hash string
+	Err  error
+}
+
+// CanaryStartedEvent is emitted when a fetched binary
+// starts running alongside the current program
+type CanaryStartedEvent struct {
+	Hash    string
+	Version string
+	SlaveID int
+	PID     int
+}
+
+// CanaryPassedEvent is emitted when a canary survived the
+// Canary period and its binary is about to be installed
+type CanaryPassedEvent struct {
+	Hash    string
+	Version string
+}
+
+// BinaryReplacedEvent is emitted once a new binary has been installed
+type BinaryReplacedEvent struct {
+	PrevHash    string
+	Hash        string
+	PrevVersion string
+	Version     string
+}
+
+// UpgradeCommittedEvent is emitted when an upgraded binary
+// passes Probation and its backup is discarded
+type UpgradeCommittedEvent struct {
+	Hash    string
+	Version string
+}
+
+// RolledBackEvent is emitted when an upgraded binary
+// failed and the previous binary has been restored
+type RolledBackEvent struct {
+	Hash         string
+	RestoredHash string
+	Reason       string
+}
+
+// RestartTriggeredEvent is emitted when a graceful restart begins
+type RestartTriggeredEvent struct {
+	SlaveID int
+	PID     int
+}
+
+// GracefulTimeoutEvent is emitted when the program did not exit
+// within TerminateTimeout of a restart and is sent a SIGKILL
+type GracefulTimeoutEvent struct {
+	SlaveID int
+	PID     int
+	Timeout time.Duration
+}
+
+// SlaveStartedEvent is emitted when a process running the program starts
+type SlaveStartedEvent struct {
+	SlaveID int
+	PID     int
+	Hash    string
+}
+
+// SlaveReadyEvent is emitted when the program calls State.Ready()
+type SlaveReadyEvent struct {
+	SlaveID int
+	PID     int
+}
+
+// SlaveExitedEvent is emitted when a process running the program
+// exits. Expected is false if the master did not ask it to stop.
+type SlaveExitedEvent struct {
+	SlaveID  int
+	PID      int
+	ExitCode int
+	Expected bool
+}
+
+// CrashRestartEvent is emitted when the RestartPolicy
+// restarts a program which exited unexpectedly
+type CrashRestartEvent struct {
+	SlaveID  int
+	PID      int
+	ExitCode int
+	Backoff  time.Duration
+}
+
+// CrashLoopEvent is emitted when a program exceeds MaxRestarts
+// within RestartWindow and the master gives up restarting it
+type CrashLoopEvent struct {
+	ExitCode int
+	Restarts int
+	Window   time.Duration
+}
+
+func (FetchStartedEvent) Kind() string      { return "fetch-started" }
+func (NoUpdateEvent) Kind() string          { return "no-update" }
+func (FetchFailedEvent) Kind() string       { return "fetch-failed" }
+func (DownloadFinishedEvent) Kind() string  { return "download-finished" }
+func (UpgradeRefusedEvent) Kind() string    { return "upgrade-refused" }
+func (SanityCheckFailedEvent) Kind() string { return "sanity-check-failed" }
+func (CanaryStartedEvent) Kind() string     { return "canary-started" }
+func (CanaryPassedEvent) Kind() string      { return "canary-passed" }
+func (BinaryReplacedEvent) Kind() string    { return "binary-replaced" }
+func (UpgradeCommittedEvent) Kind() string  { return "upgrade-committed" }
+func (RolledBackEvent) Kind() string        { return "rolled-back" }
+func (RestartTriggeredEvent) Kind() string  { return "restart-triggered" }
+func (GracefulTimeoutEvent) Kind() string   { return "graceful-timeout" }
+func (SlaveStartedEvent) Kind() string      { return "slave-started" }
+func (SlaveReadyEvent) Kind() string        { return "slave-ready" }
+func (SlaveExitedEvent) Kind() string       { return "slave-exited" }
+func (CrashRestartEvent) Kind() string      { return "crash-restart" }
+func (CrashLoopEvent) Kind() string         { return "crash-loop" }
+
+// eventQueue delivers events to Config.OnEvent in order,
+// from its own goroutine so slow handlers can't stall the master.
+// Events are dropped while the queue is full.
+type eventQueue struct {
+	fn      func(Event)
+	ch      chan Event
+	pending sync.WaitGroup
+	dropped atomic.Int64
+}
+
+func newEventQueue(fn func(Event)) *eventQueue {
+	q := &eventQueue{fn: fn, ch: make(chan Event, 64)}
+	go func() {
+		for e := range q.ch {
+			q.fn(e)
+			q.pending.Done()
+		}
+	}()
+	return q
+}
+
+func (mp *master) emit(e Event) {
+	if mp.metrics != nil {
+		mp.metrics.observe(e)
+	}
+	if mp.events == nil {
+		return
+	}
+	mp.events.pending.Add(1)
+	select {
+	case mp.events.ch <- e:
+	default:
+		//never block the master on a slow handler
+		mp.events.pending.Done()
+		n := mp.events.dropped.Add(1)
+		if mp.metrics != nil {
+			mp.metrics.droppedEvent()
+		}
+		mslog.Warn("event queue full, dropped event", "kind", e.Kind(), "dropped", n)
+	}
+}
+
+// exit delivers any pending events before exiting the master
+func (mp *master) exit(code int) {
+	if mp.events != nil {
+		flushed := make(chan bool)
+		go func() {
+			mp.events.pending.Wait()
+			close(flushed)
+		}()
+		select {
+		case <-flushed:
+		case <-time.After(5 * time.Second):
+			mslog.Warn("timed out delivering events")
+		}
+	}
+	os.Exit(code)
+}
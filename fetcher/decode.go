@@ -0,0 +1,227 @@
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compressed assets are named with these suffixes
+var compressedSuffixes = map[string][]string{
+	"gzip":  {".gz", ".tgz"},
+	"bzip2": {".bz2", ".tbz2"},
+	"xz":    {".xz", ".txz"},
+	"zstd":  {".zst", ".tzst"},
+}
+
+// format detects the format of an asset by its magic bytes, which
+// every compression format has. Tar archives without the ustar
+// magic are detected by the suffix of the asset's name. Also
+// returns the name of the decompressed asset, without the suffix.
+func format(magic []byte, name string) (string, string) {
+	f := ""
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		f = "gzip"
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		f = "bzip2"
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		f = "xz"
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		f = "zstd"
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		f = "zip"
+	case len(magic) >= 262 && string(magic[257:262]) == "ustar":
+		f = "tar"
+	case strings.HasSuffix(strings.ToLower(name), ".tar"):
+		f = "tar"
+	}
+	lower := strings.ToLower(name)
+	for i, suffix := range compressedSuffixes[f] {
+		if strings.HasSuffix(lower, suffix) {
+			name = name[:len(name)-len(suffix)]
+			if i == 1 {
+				//.tgz is short for .tar.gz
+				name += ".tar"
+			}
+			break
+		}
+	}
+	return f, name
+}
+
+// decode returns the binary from the asset called name. Compressed
+// assets are decompressed and the entry is extracted from archives.
+// Once the binary is read, the rest of the asset is read from body
+// so checks of the whole asset are made. Closing the returned
+// io.Reader closes body.
+func decode(body io.ReadCloser, name, entry string) (io.Reader, error) {
+	closer := &closers{body}
+	r := io.Reader(body)
+	for {
+		br := bufio.NewReaderSize(r, 512)
+		//a short asset is left to fail the sanity check
+		magic, _ := br.Peek(262)
+		r = br
+		var f string
+		f, name = format(magic, name)
+		var err error
+		switch f {
+		case "gzip":
+			var gz *gzip.Reader
+			if gz, err = gzip.NewReader(r); err == nil {
+				*closer = append(*closer, gz)
+				r = gz
+			}
+		case "bzip2":
+			r = bzip2.NewReader(r)
+		case "xz":
+			r, err = xz.NewReader(r)
+		case "zstd":
+			var zr *zstd.Decoder
+			if zr, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1)); err == nil {
+				*closer = append(*closer, zr.IOReadCloser())
+				r = zr
+			}
+		case "tar":
+			r, err = extractTar(r, entry)
+		case "zip":
+			r, err = extractZip(r, entry, closer)
+		}
+		if err != nil {
+			closer.Close()
+			return nil, fmt.Errorf("%s asset (%s)", f, err)
+		}
+		if f == "" || f == "tar" || f == "zip" {
+			return &decoded{Reader: r, body: body, Closer: closer}, nil
+		}
+	}
+}
+
+// Decode returns the binary in an asset as the built-in fetchers
+// stream it: compressed assets are decompressed and the entry is
+// extracted from archives, the format is detected from the magic
+// bytes and name of the asset. Signatures are verified against the
+// binary rather than the asset, so sign the binary Decode returns.
+func Decode(asset io.ReadCloser, name, entry string) (io.ReadCloser, error) {
+	r, err := decode(asset, name, entry)
+	if err != nil {
+		return nil, err
+	}
+	return r.(*decoded), nil
+}
+
+// decoded is the binary extracted from an asset
+type decoded struct {
+	io.Reader
+	body io.Reader
+	io.Closer
+}
+
+func (d *decoded) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	if err == io.EOF {
+		if _, err := io.Copy(io.Discard, d.body); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// extractTar finds the entry in a tar archive
+func extractTar(r io.Reader, entry string) (io.Reader, error) {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg && path.Base(h.Name) == entry {
+			return tr, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s in archive", entry)
+}
+
+// zip archives are written to a temp file, up to this size
+const maxZipSize = 1 << 30
+
+// extractZip finds the entry in a zip archive, which is first
+// written to a temp file, removed once the binary is closed
+func extractZip(r io.Reader, entry string, closer *closers) (io.Reader, error) {
+	tmp, err := os.CreateTemp("", "selfup-zip-")
+	if err != nil {
+		return nil, err
+	}
+	*closer = append(*closer, removeCloser{tmp})
+	size, err := io.CopyN(tmp, r, maxZipSize+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if size > maxZipSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxZipSize)
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.Mode().IsRegular() && path.Base(f.Name) == entry {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			*closer = append(*closer, rc)
+			return rc, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s in archive", entry)
+}
+
+// defaultEntry is the base name of the executable
+func defaultEntry() string {
+	p, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(p)
+}
+
+// closers are closed in reverse order
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var errs []error
+	for i := len(c) - 1; i >= 0; i-- {
+		if err := c[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeCloser removes a temp file when it's closed
+type removeCloser struct {
+	*os.File
+}
+
+func (r removeCloser) Close() error {
+	err := r.File.Close()
+	os.Remove(r.Name())
+	return err
+}
@@ -0,0 +1,178 @@
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var binaryContents = []byte("selfup binary\n")
+
+// bzip2Binary is binaryContents compressed with the bzip2
+// command, as the standard library can't compress bzip2
+var bzip2Binary = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x83, 0x5d, 0x79, 0xfe, 0x00, 0x00,
+	0x05, 0xd1, 0x80, 0x00, 0x10, 0x40, 0x00, 0x33, 0x25, 0x5a, 0x20, 0x20, 0x00, 0x31, 0x00, 0x00,
+	0x0a, 0x60, 0x4c, 0x69, 0xa8, 0x73, 0x1f, 0x45, 0x58, 0x20, 0x69, 0xf8, 0xbb, 0x92, 0x29, 0xc2,
+	0x84, 0x84, 0x1a, 0xeb, 0xcf, 0xf0,
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func xzipped(t *testing.T, b []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := xz.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdCompressed(t *testing.T, b []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := zstd.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tarred archives the files, by name
+func tarred(t *testing.T, files ...string) []byte {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for _, name := range files {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(binaryContents)), Typeflag: tar.TypeReg})
+		w.Write(binaryContents)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zipped archives the files, by name
+func zipped(t *testing.T, files ...string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, name := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(binaryContents)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFormat(t *testing.T) {
+	gz := gzipped(t, nil)
+	tests := []struct {
+		magic        []byte
+		name         string
+		format, base string
+	}{
+		{gz, "myapp.gz", "gzip", "myapp"},
+		{gz, "myapp.GZ", "gzip", "myapp"},
+		//.tgz is renamed so its tar archive is found by the suffix
+		{gz, "myapp.tgz", "gzip", "myapp.tar"},
+		{gz, "myapp", "gzip", "myapp"},
+		{bzip2Binary, "myapp.tbz2", "bzip2", "myapp.tar"},
+		{xzipped(t, nil), "myapp.txz", "xz", "myapp.tar"},
+		{zstdCompressed(t, binaryContents), "myapp.tar.zst", "zstd", "myapp.tar"},
+		{zipped(t, "myapp"), "myapp.zip", "zip", "myapp.zip"},
+		{tarred(t, "myapp"), "myapp", "tar", "myapp"},
+		{[]byte("no magic"), "myapp.tar", "tar", "myapp.tar"},
+		{[]byte("\x7fELF"), "myapp", "", "myapp"},
+	}
+	for _, test := range tests {
+		format, base := format(test.magic, test.name)
+		if format != test.format || base != test.base {
+			t.Errorf("format(%s) = %q, %q, want %q, %q", test.name, format, base, test.format, test.base)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		asset []byte
+		err   string
+	}{
+		{"myapp", binaryContents, ""},
+		{"myapp.gz", gzipped(t, binaryContents), ""},
+		{"myapp.bz2", bzip2Binary, ""},
+		{"myapp.xz", xzipped(t, binaryContents), ""},
+		{"myapp.zst", zstdCompressed(t, binaryContents), ""},
+		{"myapp.tar", tarred(t, "README", "myapp"), ""},
+		{"myapp.tar.gz", gzipped(t, tarred(t, "myapp-1.0/LICENSE", "myapp-1.0/bin/myapp")), ""},
+		{"myapp.tgz", gzipped(t, tarred(t, "myapp")), ""},
+		{"myapp.tar.xz", xzipped(t, tarred(t, "bin/myapp")), ""},
+		{"myapp.zip", zipped(t, "README", "myapp-1.0/myapp"), ""},
+		{"myapp.tar.gz", gzipped(t, tarred(t, "README", "bin/other")), "tar asset (no myapp in archive)"},
+		{"myapp.zip", zipped(t, "README"), "zip asset (no myapp in archive)"},
+		{"myapp.gz", []byte{0x1f, 0x8b, 0x00}, "gzip asset"},
+	}
+	for _, test := range tests {
+		r, err := decode(io.NopCloser(bytes.NewReader(test.asset)), test.name, "myapp")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("decode(%s) error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("decode(%s) error %s", test.name, err)
+			continue
+		}
+		b, err := io.ReadAll(r)
+		r.(io.Closer).Close()
+		if err != nil || !bytes.Equal(b, binaryContents) {
+			t.Errorf("decode(%s) = %q, %v, want %q", test.name, b, err, binaryContents)
+		}
+	}
+}
+
+// TestDecodeZipRemoved checks the temp file of a zip archive is
+// removed once the binary is closed, or the entry isn't found
+func TestDecodeZipRemoved(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	for _, asset := range [][]byte{zipped(t, "myapp"), zipped(t, "README")} {
+		r, err := Decode(io.NopCloser(bytes.NewReader(asset)), "myapp.zip", "myapp")
+		if err == nil {
+			io.ReadAll(r)
+			r.Close()
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+			t.Fatalf("temp file %s not removed", entries[0].Name())
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Download configures how the HTTP, S3, Github and Delta fetchers download
+// binaries. Failed requests are retried with an exponential backoff
+// and jitter, and interrupted downloads are resumed using HTTP Range
+// requests. Downloads shorter than their Content-Length are retried.
+type Download struct {
+	//Retries of a failed or interrupted download, defaults
+	//to 5, a negative number disables retries
+	Retries int
+	//Backoff before the first retry, doubled for each
+	//following retry, defaults to 1 second
+	Backoff time.Duration
+	//MaxBackoff defaults to 30 seconds
+	MaxBackoff time.Duration
+	//Progress is called as the binary is received, total
+	//is -1 when the server didn't send a Content-Length
+	Progress func(received, total int64)
+	//Retry is called before each retry with the error
+	//which caused it and the backoff before the retry
+	Retry func(err error, retry int, backoff time.Duration)
+}
+
+func (d Download) withDefaults() Download {
+	if d.Retries == 0 {
+		d.Retries = 5
+	} else if d.Retries < 0 {
+		d.Retries = 0
+	}
+	if d.Backoff <= 0 {
+		d.Backoff = 1 * time.Second
+	}
+	if d.MaxBackoff <= 0 {
+		d.MaxBackoff = 30 * time.Second
+	}
+	return d
+}
+
+// backoff before the given retry, between half and all
+// of the exponential backoff so clients don't retry together
+func (d Download) backoff(retry int) time.Duration {
+	b := d.Backoff << (retry - 1)
+	if b > d.MaxBackoff || b <= 0 {
+		b = d.MaxBackoff
+	}
+	return b/2 + time.Duration(rand.Int63n(int64(b/2)+1))
+}
+
+// request performs a download request, header holds
+// the Range headers when the download is resumed
+type request func(ctx context.Context, header http.Header) (*http.Response, error)
+
+// get performs the request, retrying on errors and server errors.
+// Once it succeeds, the response body resumes the download when it
+// is interrupted. Other responses are returned for the caller to check.
+func (d Download) get(ctx context.Context, do request) (*http.Response, error) {
+	d = d.withDefaults()
+	var resp *http.Response
+	var err error
+	retry := 0
+	for ; ; retry++ {
+		if retry > 0 {
+			if err := d.wait(ctx, retry, err, resp); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = do(ctx, http.Header{})
+		if err == nil && !retryable(resp.StatusCode) {
+			break
+		}
+		if ctx.Err() != nil || retry == d.Retries {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	dl := &download{
+		Download: d,
+		ctx:      ctx,
+		do:       do,
+		body:     resp.Body,
+		total:    resp.ContentLength,
+		retries:  retry,
+	}
+	//the validator ensures a resumed download is of the same binary
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		dl.validator = etag
+	} else {
+		dl.validator = resp.Header.Get("Last-Modified")
+	}
+	resp.Body = dl
+	return resp, nil
+}
+
+// wait out the backoff before a retry
+func (d Download) wait(ctx context.Context, retry int, err error, resp *http.Response) error {
+	if err == nil && resp != nil {
+		err = errors.New(resp.Status)
+	}
+	backoff := d.backoff(retry)
+	if d.Retry != nil {
+		d.Retry(err, retry, backoff)
+	}
+	select {
+	case <-time.After(backoff):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryable status codes are temporary server errors
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// download is a response body which resumes when interrupted
+type download struct {
+	Download
+	ctx       context.Context
+	do        request
+	body      io.ReadCloser
+	validator string
+	received  int64
+	total     int64
+	retries   int
+	//the error which interrupted the download
+	err error
+}
+
+func (d *download) Read(p []byte) (int, error) {
+	for {
+		if d.body == nil {
+			if err := d.resume(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := d.body.Read(p)
+		d.received += int64(n)
+		if d.total >= 0 && d.received > d.total {
+			return n, fmt.Errorf("received more than the Content-Length of %d bytes", d.total)
+		}
+		if n > 0 && d.Progress != nil {
+			d.Progress(d.received, d.total)
+		}
+		if err == io.EOF && d.total >= 0 && d.received < d.total {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		//interrupted, resume on the next read
+		d.body.Close()
+		d.body = nil
+		if d.ctx.Err() != nil || d.retries == d.Retries {
+			return n, err
+		}
+		d.err = fmt.Errorf("interrupted after %d bytes: %w", d.received, err)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume requests the rest of the binary
+func (d *download) resume() error {
+	err := d.err
+	var resp *http.Response
+	for d.retries < d.Retries {
+		d.retries++
+		if err := d.wait(d.ctx, d.retries, err, resp); err != nil {
+			return err
+		}
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(d.received, 10)+"-")
+		if d.validator != "" {
+			header.Set("If-Range", d.validator)
+		}
+		resp, err = d.do(d.ctx, header)
+		if err != nil {
+			resp = nil
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+			if start, total, ok := contentRange(resp.Header.Get("Content-Range")); !ok || start != d.received || (d.total >= 0 && total != d.total) {
+				resp.Body.Close()
+				return fmt.Errorf("download resumed with an invalid range (%s)", resp.Header.Get("Content-Range"))
+			}
+			d.body = resp.Body
+			return nil
+		case resp.StatusCode == http.StatusOK:
+			//the range was ignored, skip what was already received
+			if d.validator == "" || (resp.Header.Get("ETag") != d.validator && resp.Header.Get("Last-Modified") != d.validator) {
+				resp.Body.Close()
+				return errors.New("binary changed during download")
+			}
+			if _, err = io.CopyN(io.Discard, resp.Body, d.received); err != nil {
+				resp.Body.Close()
+				resp = nil
+				continue
+			}
+			d.body = resp.Body
+			return nil
+		case retryable(resp.StatusCode):
+			resp.Body.Close()
+		default:
+			resp.Body.Close()
+			return fmt.Errorf("download resume failed (%s)", resp.Status)
+		}
+	}
+	if err == nil && resp != nil {
+		err = errors.New(resp.Status)
+	}
+	return fmt.Errorf("download failed after %d retries (%s)", d.retries, err)
+}
+
+func (d *download) Close() error {
+	if d.body == nil {
+		return nil
+	}
+	return d.body.Close()
+}
+
+// contentRange parses "bytes <start>-<end>/<total>", total is -1 if unknown
+func contentRange(header string) (start, total int64, ok bool) {
+	r, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	r, size, found := strings.Cut(r, "/")
+	if !found {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(r, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if size == "*" {
+		return start, -1, true
+	}
+	if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// completed calls done once body has been read to the end, so
+// fetchers only skip a binary once it has been fully downloaded
+func completed(body io.ReadCloser, done func()) io.ReadCloser {
+	return &completedBody{ReadCloser: body, done: done}
+}
+
+type completedBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (c *completedBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err == io.EOF {
+		c.once.Do(c.done)
+	}
+	return n, err
+}
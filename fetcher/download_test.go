@@ -0,0 +1,203 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentRange(t *testing.T) {
+	tests := []struct {
+		header       string
+		start, total int64
+		ok           bool
+	}{
+		{"bytes 0-9/10", 0, 10, true},
+		{"bytes 5-9/10", 5, 10, true},
+		{"bytes 5-9/*", 5, -1, true},
+		{"", 0, 0, false},
+		{"bytes */10", 0, 0, false},
+		{"bytes 5-9", 0, 0, false},
+		{"items 5-9/10", 0, 0, false},
+		{"bytes x-9/10", 0, 0, false},
+		{"bytes 5-9/x", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, total, ok := contentRange(test.header)
+		if start != test.start || total != test.total || ok != test.ok {
+			t.Errorf("contentRange(%q) = %d, %d, %v, want %d, %d, %v", test.header, start, total, ok, test.start, test.total, test.ok)
+		}
+	}
+}
+
+// interruptedServer serves data, the first request is interrupted after
+// half of it, the rest is served by resumed, which records their headers
+func interruptedServer(t *testing.T, data []byte, resumed func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *[]http.Header) {
+	headers := []http.Header{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Clone())
+		if len(headers) > 1 {
+			resumed(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(s.Close)
+	return s, &headers
+}
+
+// httpGet downloads url with d
+func httpGet(d Download, url string) ([]byte, error) {
+	resp, err := d.get(context.Background(), func(ctx context.Context, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header
+		return http.DefaultClient.Do(req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func TestDownloadResume(t *testing.T) {
+	data := bytes.Repeat([]byte("selfup"), 1000)
+	s, headers := interruptedServer(t, data, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	})
+	retries := 0
+	d := Download{
+		Backoff: time.Millisecond,
+		Retry: func(err error, retry int, backoff time.Duration) {
+			retries++
+		},
+	}
+	b, err := httpGet(d, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("received %d bytes, want %d", len(b), len(data))
+	}
+	if retries != 1 {
+		t.Fatalf("%d retries, want 1", retries)
+	}
+	resume := (*headers)[1]
+	if r := resume.Get("Range"); r != "bytes=3000-" {
+		t.Fatalf("Range %q, want bytes=3000-", r)
+	}
+	if r := resume.Get("If-Range"); r != `"v1"` {
+		t.Fatalf(`If-Range %q, want "v1"`, r)
+	}
+}
+
+// TestDownloadRangeIgnored resumes from servers
+// which ignore the range and send the whole binary
+func TestDownloadRangeIgnored(t *testing.T) {
+	data := bytes.Repeat([]byte("selfup"), 1000)
+	for _, etag := range []string{`"v1"`, `"v2"`} {
+		s, _ := interruptedServer(t, data, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			w.Write(data)
+		})
+		b, err := httpGet(Download{Backoff: time.Millisecond}, s.URL)
+		if etag == `"v1"` {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Fatalf("received %d bytes, want %d", len(b), len(data))
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "binary changed") {
+			t.Fatalf("changed binary resumed (%v)", err)
+		}
+	}
+}
+
+// response is a fake response with the given Content-Length
+func response(status int, body string, length int64, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Status:        http.StatusText(status),
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: length,
+	}
+}
+
+func TestDownloadShortBody(t *testing.T) {
+	//without retries the download fails
+	d := Download{Retries: -1}
+	resp, err := d.get(context.Background(), func(ctx context.Context, header http.Header) (*http.Response, error) {
+		return response(http.StatusOK, "short", 10, nil), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("short body read (%v), want %s", err, io.ErrUnexpectedEOF)
+	}
+	//otherwise it's resumed from the end of the short body
+	ranges := []string{}
+	d = Download{Backoff: time.Millisecond}
+	resp, err = d.get(context.Background(), func(ctx context.Context, header http.Header) (*http.Response, error) {
+		ranges = append(ranges, header.Get("Range"))
+		if len(ranges) == 1 {
+			return response(http.StatusOK, "short", 10, http.Header{"Etag": {`"v1"`}}), nil
+		}
+		return response(http.StatusPartialContent, "body!", 5, http.Header{"Content-Range": {"bytes 5-9/10"}}), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "shortbody!" {
+		t.Fatalf("received %q, want shortbody!", b)
+	}
+	if ranges[1] != "bytes=5-" {
+		t.Fatalf("Range %q, want bytes=5-", ranges[1])
+	}
+}
+
+// TestDownloadInvalidRange resumes with ranges which
+// don't follow on from the bytes already received
+func TestDownloadInvalidRange(t *testing.T) {
+	for _, cr := range []string{"bytes 0-9/10", "bytes 5-10/11", "bytes 5-9"} {
+		d := Download{Backoff: time.Millisecond}
+		calls := 0
+		resp, err := d.get(context.Background(), func(ctx context.Context, header http.Header) (*http.Response, error) {
+			calls++
+			if calls == 1 {
+				return response(http.StatusOK, "short", 10, http.Header{"Etag": {`"v1"`}}), nil
+			}
+			return response(http.StatusPartialContent, "body!", 5, http.Header{"Content-Range": {cr}}), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(resp.Body); err == nil || !strings.Contains(err.Error(), "invalid range") {
+			t.Fatalf("resumed with Content-Range %q (%v)", cr, err)
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package fetcher
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
 
 // Interface defines the required fetcher functions
 type Interface interface {
@@ -14,12 +19,228 @@ type Interface interface {
 	//form of an io.Reader. If io.Reader is nil,
 	//then it is assumed there are no updates. Fetch
 	//will be run repeatedly and forever. It is up the
-	//implementation to throttle the fetch frequency.
+	//implementation to throttle the fetch frequency,
+	//unless it implements ContextInterface.
 	Fetch(binStat *BinStat) (io.Reader, error)
 }
 
+// ContextInterface is implemented by fetchers which leave
+// throttling to selfup and can be cancelled. The built-in
+// fetchers implement it, others are adapted with WithContext.
+type ContextInterface interface {
+	Interface
+	//FetchContext is Fetch without the throttling, it is
+	//run every FetchInterval. Requests should be made with
+	//ctx, and reading the returned io.Reader should fail
+	//once ctx is cancelled.
+	FetchContext(ctx context.Context, binStat *BinStat) (io.Reader, error)
+	//FetchInterval is the delay between calls to FetchContext,
+	//selfup's MinFetchInterval is used when it is shorter.
+	FetchInterval() time.Duration
+}
+
+// BinStat describes the binary which is currently running
 type BinStat struct {
+	//Hash of the running binary
 	Hash string
+	//Version of the running binary, empty if unknown
+	Version string
+}
+
+// Signed is optionally implemented by the io.Reader returned
+// from Fetch, it provides the detached signature of the binary
+// being streamed. It is only called when a verifier is in use.
+type Signed interface {
+	Signature() ([]byte, error)
+}
+
+// Versioned is optionally implemented by the io.Reader returned
+// from Fetch, it provides the version of the binary being streamed
+// so downgrades can be refused before it is downloaded.
+type Versioned interface {
+	Version() string
+}
+
+// Patched is optionally implemented by the io.Reader returned
+// from Fetch when it streams a bsdiff patch of the running binary
+// (see Diff) rather than the binary itself.
+type Patched interface {
+	//PatchHash is the hash of the patched binary,
+	//empty if the stream is not a patch
+	PatchHash() string
+	//Full fetches the binary, it is used instead when
+	//the patch can't be applied to the running binary
+	Full() (io.Reader, error)
+}
+
+// WithSignature attaches a detached signature
+// to the binary stream returned from Fetch
+func WithSignature(r io.Reader, signature func() ([]byte, error)) io.Reader {
+	b := wrap(r)
+	b.signature = signature
+	return b
+}
+
+// WithVersion attaches a version to the
+// binary stream returned from Fetch
+func WithVersion(r io.Reader, version string) io.Reader {
+	b := wrap(r)
+	b.version = version
+	return b
+}
+
+// WithPatch marks the stream returned from Fetch as a patch
+// of the running binary into the binary with the given hash
+func WithPatch(r io.Reader, hash string, full func() (io.Reader, error)) io.Reader {
+	b := wrap(r)
+	b.patchHash = hash
+	b.full = full
+	return b
+}
+
+// binary is a stream annotated using With* functions
+type binary struct {
+	io.Reader
+	signature func() ([]byte, error)
+	version   string
+	patchHash string
+	full      func() (io.Reader, error)
+}
+
+func wrap(r io.Reader) *binary {
+	if b, ok := r.(*binary); ok {
+		return b
+	}
+	return &binary{Reader: r}
+}
+
+func (b *binary) Signature() ([]byte, error) {
+	if b.signature == nil {
+		return nil, errors.New("no signature")
+	}
+	return b.signature()
+}
+
+func (b *binary) Version() string {
+	return b.version
+}
+
+func (b *binary) PatchHash() string {
+	return b.patchHash
+}
+
+func (b *binary) Full() (io.Reader, error) {
+	if b.full == nil {
+		return nil, errors.New("no full binary")
+	}
+	return b.full()
+}
+
+func (b *binary) Close() error {
+	if c, ok := b.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+const (
+	//detached signatures are stored next to their binaries with this suffix
+	signatureSuffix = ".sig"
+	//signatures are small, anything larger is an error
+	maxSignatureSize = 64 << 10
+)
+
+func readSignature(r io.Reader) ([]byte, error) {
+	sig, err := io.ReadAll(io.LimitReader(r, maxSignatureSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) > maxSignatureSize {
+		return nil, errors.New("signature too large")
+	}
+	return sig, nil
+}
+
+// WithContext adapts a fetcher to the ContextInterface. Fetchers
+// which don't implement it throttle themselves in Fetch, so their
+// FetchInterval is 0. When ctx is cancelled, FetchContext returns
+// without waiting for Fetch and reads of its io.Reader fail.
+func WithContext(f Interface) ContextInterface {
+	if c, ok := f.(ContextInterface); ok {
+		return c
+	}
+	return &contextFetcher{Interface: f}
+}
+
+type contextFetcher struct {
+	Interface
+}
+
+func (f *contextFetcher) FetchContext(ctx context.Context, binStat *BinStat) (io.Reader, error) {
+	type result struct {
+		r   io.Reader
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		r, err := f.Fetch(binStat)
+		results <- result{r, err}
+	}()
+	select {
+	case res := <-results:
+		if res.r == nil || res.err != nil {
+			return res.r, res.err
+		}
+		return withContext(ctx, res.r), nil
+	case <-ctx.Done():
+		//close the stream whenever the fetch returns
+		go func() {
+			if c, ok := (<-results).r.(io.Closer); ok {
+				c.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (f *contextFetcher) FetchInterval() time.Duration {
+	return 0
+}
+
+// withContext fails reads of the stream once ctx is cancelled,
+// keeping its annotations and closer
+func withContext(ctx context.Context, r io.Reader) io.Reader {
+	b := &binary{Reader: &contextReader{ctx: ctx, r: r}}
+	if s, ok := r.(Signed); ok {
+		b.signature = s.Signature
+	}
+	if v, ok := r.(Versioned); ok {
+		b.version = v.Version()
+	}
+	if p, ok := r.(Patched); ok {
+		b.patchHash = p.PatchHash()
+		b.full = p.Full
+	}
+	return b
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func (c *contextReader) Close() error {
+	if closer, ok := c.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
 
 // Func converts a fetch function into the fetcher interface
@@ -0,0 +1,227 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kr/binarydist"
+	"github.com/rainkfun/go-kit/hash"
+)
+
+// Delta polls the hash of the latest binary and, when it changes,
+// downloads a bsdiff patch from the running binary so only the
+// changes are transferred. The binary itself is downloaded when
+// there's no patch for the running binary or it can't be applied.
+// Use WriteDelta to publish the hash and patches next to the binary.
+type Delta struct {
+	//URL of the latest binary
+	URL string
+	//HashURL of the hash of the latest binary,
+	//defaults to URL + ".hash"
+	HashURL string
+	//PatchURL of the patch from the running binary, "{hash}" is
+	//replaced by its hash, defaults to URL + ".{hash}.patch"
+	PatchURL string
+	//SignatureURL of the detached signature of the
+	//binary, defaults to URL + ".sig"
+	SignatureURL string
+	//Interval between hash checks, defaults to 5 minutes
+	Interval time.Duration
+	//Download configures retries and progress
+	Download Download
+	//Fallback is called when there's no patch from the running
+	//binary, with the error, before the binary is downloaded
+	Fallback func(err error)
+	//internal state
+	delay bool
+	last  string
+}
+
+// Init validates the provided config
+func (d *Delta) Init() error {
+	if d.URL == "" {
+		return fmt.Errorf("URL required")
+	}
+	if d.HashURL == "" {
+		d.HashURL = d.URL + hashSuffix
+	}
+	if d.PatchURL == "" {
+		d.PatchURL = d.URL + ".{hash}" + patchSuffix
+	}
+	if d.SignatureURL == "" {
+		d.SignatureURL = d.URL + signatureSuffix
+	}
+	if d.Interval == 0 {
+		d.Interval = 5 * time.Minute
+	}
+	return nil
+}
+
+// Fetch the patch or binary from the provided URLs, every Interval
+func (d *Delta) Fetch(binStat *BinStat) (io.Reader, error) {
+	//delay fetches after first
+	if d.delay {
+		time.Sleep(d.Interval)
+	}
+	d.delay = true
+	return d.FetchContext(context.Background(), binStat)
+}
+
+// FetchInterval is the Interval
+func (d *Delta) FetchInterval() time.Duration {
+	return d.Interval
+}
+
+// FetchContext fetches the patch or binary from the provided URLs
+func (d *Delta) FetchContext(ctx context.Context, binStat *BinStat) (io.Reader, error) {
+	latest, err := d.latestHash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if latest == binStat.Hash || latest == d.last {
+		return nil, nil //skip, hash match
+	}
+	//the hash is only skipped once its binary is received
+	received := func() {
+		d.last = latest
+	}
+	signature := func() ([]byte, error) {
+		return d.signature(ctx)
+	}
+	full := func() (io.Reader, error) {
+		//the patch was received but couldn't be applied
+		d.last = ""
+		r, err := d.get(ctx, d.URL, received)
+		if err != nil {
+			return nil, fmt.Errorf("GET request failed (%s)", err)
+		}
+		return WithSignature(r, signature), nil
+	}
+	patch, err := d.get(ctx, strings.ReplaceAll(d.PatchURL, "{hash}", binStat.Hash), received)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if d.Fallback != nil {
+			d.Fallback(fmt.Errorf("no patch from %s (%s)", binStat.Hash, err))
+		}
+		return full()
+	}
+	//success!
+	return WithPatch(WithSignature(patch, signature), latest, full), nil
+}
+
+// latestHash fetches the hash of the latest binary
+func (d *Delta) latestHash(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.HashURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("hash request failed (%s)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("hash request failed (status code %d)", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", fmt.Errorf("hash request failed (%s)", err)
+	}
+	latest := strings.TrimSpace(string(b))
+	if latest == "" {
+		return "", fmt.Errorf("empty hash at %s", d.HashURL)
+	}
+	return latest, nil
+}
+
+// get downloads url, calling received once it's read to the end
+func (d *Delta) get(ctx context.Context, url string, received func()) (io.Reader, error) {
+	resp, err := d.Download.get(ctx, func(ctx context.Context, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header
+		return http.DefaultClient.Do(req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return completed(resp.Body, received), nil
+}
+
+func (d *Delta) signature(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.SignatureURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("signature request failed (%s)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signature request failed (status code %d)", resp.StatusCode)
+	}
+	return readSignature(resp.Body)
+}
+
+const (
+	//the hash of the latest binary is stored next to it with this suffix
+	hashSuffix = ".hash"
+	//patches are stored next to the latest binary as <binary>.<hash>.patch
+	patchSuffix = ".patch"
+)
+
+// Diff writes a bsdiff patch from the old binary to the new one,
+// which selfup applies when it's streamed by a fetcher using WithPatch.
+// Writing patches requires the bzip2 command.
+func Diff(old, new io.Reader, patch io.Writer) error {
+	return binarydist.Diff(old, new, patch)
+}
+
+// WriteDelta publishes the binary at binPath for the Delta fetcher.
+// It writes its hash to binPath + ".hash" and a patch from each of
+// the previous binaries to binPath + ".<hash>.patch". Writing patches
+// requires the bzip2 command.
+func WriteDelta(binPath string, previous ...string) error {
+	b, err := os.ReadFile(binPath)
+	if err != nil {
+		return err
+	}
+	for _, prev := range previous {
+		old, err := os.ReadFile(prev)
+		if err != nil {
+			return err
+		}
+		prevHash, err := hash.XXH64SumString(old)
+		if err != nil {
+			return err
+		}
+		patch := &bytes.Buffer{}
+		if err := Diff(bytes.NewReader(old), bytes.NewReader(b), patch); err != nil {
+			return fmt.Errorf("diff %s (%s)", prev, err)
+		}
+		if err := os.WriteFile(binPath+"."+prevHash+patchSuffix, patch.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	digest, err := hash.XXH64SumString(b)
+	if err != nil {
+		return err
+	}
+	//the hash is written last, once the patches to it are in place
+	return os.WriteFile(binPath+hashSuffix, []byte(digest+"\n"), 0644)
+}
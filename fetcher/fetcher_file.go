@@ -1,6 +1,7 @@
 package fetcher
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -17,6 +18,9 @@ import (
 type File struct {
 	Path     string
 	Interval time.Duration
+	//SignaturePath of the detached signature of the
+	//binary, defaults to Path + ".sig"
+	SignaturePath string
 	// hash is the file modify time and its size
 	hash  string
 	delay bool
@@ -30,19 +34,32 @@ func (f *File) Init() error {
 	if f.Interval < 1*time.Second {
 		f.Interval = 1 * time.Second
 	}
+	if f.SignaturePath == "" {
+		f.SignaturePath = f.Path + signatureSuffix
+	}
 	if err := f.updateHash(); err != nil {
 		return err
 	}
 	return nil
 }
 
-// Fetch file from the specified Path
+// Fetch file from the specified Path, every Interval
 func (f *File) Fetch(binStat *BinStat) (io.Reader, error) {
 	//only delay after first fetch
 	if f.delay {
 		time.Sleep(f.Interval)
 	}
 	f.delay = true
+	return f.FetchContext(context.Background(), binStat)
+}
+
+// FetchInterval is the Interval
+func (f *File) FetchInterval() time.Duration {
+	return f.Interval
+}
+
+// FetchContext fetches the file from the specified Path
+func (f *File) FetchContext(ctx context.Context, binStat *BinStat) (io.Reader, error) {
 	if err := f.updateHash(); err != nil {
 		return nil, err
 	}
@@ -68,7 +85,12 @@ func (f *File) Fetch(binStat *BinStat) (io.Reader, error) {
 		}
 		attempt++
 		//sleep
-		time.Sleep(rate)
+		select {
+		case <-time.After(rate):
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		}
 		//check hash!
 		if err := f.updateHash(); err != nil {
 			file.Close()
@@ -80,7 +102,16 @@ func (f *File) Fetch(binStat *BinStat) (io.Reader, error) {
 		}
 		lastHash = f.hash
 	}
-	return file, nil
+	return withContext(ctx, WithSignature(file, f.signature)), nil
+}
+
+func (f *File) signature() ([]byte, error) {
+	file, err := os.Open(f.SignaturePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readSignature(file)
 }
 
 func (f *File) updateHash() error {
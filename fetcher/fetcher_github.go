@@ -1,13 +1,17 @@
 package fetcher
 
 import (
-	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,23 +23,50 @@ import (
 type Github struct {
 	//Github username and repository name
 	User, Repo string
+	//Token authenticates requests, it's required for private
+	//repositories and raises the rate limit. Falls back to
+	//env GITHUB_TOKEN.
+	Token string
+	//BaseURL of the API, defaults to https://api.github.com.
+	//For GitHub Enterprise use https://<host>/api/v3.
+	BaseURL string
 	//Interval between fetches
 	Interval time.Duration
+	//Tag is a pattern (see path.Match) the release tag must match,
+	//for example "v2.*". By default the latest release is followed.
+	Tag string
+	//Prerelease also follows prereleases
+	Prerelease bool
 	//Asset is used to find matching release asset.
 	//By default a file will match if it contains
 	//both GOOS and GOARCH.
 	Asset func(filename string) bool
+	//Download configures retries and progress
+	Download Download
+	//Entry is the binary extracted from archive assets,
+	//defaults to the base name of the executable
+	Entry string
 	//internal state
 	releaseURL    string
 	delay         bool
 	lastETag      string
-	latestRelease struct {
-		TagName string `json:"tag_name"`
-		Assets  []struct {
-			Name string `json:"name"`
-			URL  string `json:"browser_download_url"`
-		} `json:"assets"`
-	}
+	releaseETag   string
+	limitedUntil  time.Time
+	latestRelease githubRelease
+}
+
+type githubRelease struct {
+	TagName    string        `json:"tag_name"`
+	Draft      bool          `json:"draft"`
+	Prerelease bool          `json:"prerelease"`
+	Assets     []githubAsset `json:"assets"`
+}
+
+type githubAsset struct {
+	Name string `json:"name"`
+	//API URL of the asset, which authenticated requests use
+	APIURL string `json:"url"`
+	URL    string `json:"browser_download_url"`
 }
 
 func (h *Github) defaultAsset(filename string) bool {
@@ -51,54 +82,98 @@ func (h *Github) Init() error {
 	if h.Repo == "" {
 		return fmt.Errorf("Repo required")
 	}
+	if h.Tag != "" {
+		if _, err := path.Match(h.Tag, ""); err != nil {
+			return fmt.Errorf("invalid Tag pattern (%s)", err)
+		}
+	}
 	if h.Asset == nil {
 		h.Asset = h.defaultAsset
 	}
-	h.releaseURL = "https://api.github.com/repos/" + h.User + "/" + h.Repo + "/releases/latest"
+	if h.Entry == "" {
+		h.Entry = defaultEntry()
+	}
+	if h.Token == "" {
+		h.Token = os.Getenv("GITHUB_TOKEN")
+	}
+	if h.BaseURL == "" {
+		h.BaseURL = "https://api.github.com"
+	}
+	h.releaseURL = strings.TrimSuffix(h.BaseURL, "/") + "/repos/" + h.User + "/" + h.Repo + "/releases"
+	if h.Tag == "" && !h.Prerelease {
+		h.releaseURL += "/latest"
+	} else {
+		//the latest release excludes prereleases, search the recent ones
+		h.releaseURL += "?per_page=100"
+	}
 	if h.Interval == 0 {
 		h.Interval = 5 * time.Minute
-	} else if h.Interval < 1*time.Minute {
+	} else if h.Interval < 1*time.Minute && h.Token == "" {
 		log.Printf("[selfup.github] warning: intervals less than 1 minute will surpass the public rate limit")
 	}
 	return nil
 }
 
-// Fetch the binary from the provided Repository
+// Fetch the binary from the provided Repository, every Interval
 func (h *Github) Fetch(binStat *BinStat) (io.Reader, error) {
 	//delay fetches after first
 	if h.delay {
 		time.Sleep(h.Interval)
 	}
 	h.delay = true
+	return h.FetchContext(context.Background(), binStat)
+}
+
+// FetchInterval is the Interval
+func (h *Github) FetchInterval() time.Duration {
+	return h.Interval
+}
+
+// FetchContext fetches the binary from the provided Repository
+func (h *Github) FetchContext(ctx context.Context, binStat *BinStat) (io.Reader, error) {
+	if time.Now().Before(h.limitedUntil) {
+		return nil, nil //skip, rate limited
+	}
 	//check release status
-	resp, err := http.Get(h.releaseURL)
+	etag, changed, err := h.release(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("release info request failed (%s)", err)
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("release info request failed (status code %d)", resp.StatusCode)
+	//the release is only checked again once it changes
+	checked := func() {
+		h.releaseETag = etag
 	}
-	//clear assets
-	h.latestRelease.Assets = nil
-	if err := json.NewDecoder(resp.Body).Decode(&h.latestRelease); err != nil {
-		return nil, fmt.Errorf("invalid request info (%s)", err)
+	if !changed {
+		return nil, nil //skip, release match
+	}
+	if h.latestRelease.TagName != "" && h.latestRelease.TagName == binStat.Version {
+		checked()
+		return nil, nil //skip, version match
 	}
-	resp.Body.Close()
 	//find appropriate asset
-	assetURL := ""
-	for _, a := range h.latestRelease.Assets {
-		if h.Asset(a.Name) {
-			assetURL = a.URL
+	var asset, sigAsset *githubAsset
+	for i, a := range h.latestRelease.Assets {
+		if !strings.HasSuffix(a.Name, signatureSuffix) && h.Asset(a.Name) {
+			asset = &h.latestRelease.Assets[i]
 			break
 		}
 	}
-	if assetURL == "" {
+	if asset == nil {
 		return nil, fmt.Errorf("no matching assets in this release (%s)", h.latestRelease.TagName)
 	}
-	//fetch location
-	req, _ := http.NewRequest("HEAD", assetURL, nil)
-	resp, err = http.DefaultTransport.RoundTrip(req)
+	//find its detached signature
+	for i, a := range h.latestRelease.Assets {
+		if a.Name == asset.Name+signatureSuffix {
+			sigAsset = &h.latestRelease.Assets[i]
+			break
+		}
+	}
+	//fetch location, without following the redirect
+	req, err := h.assetRequest(ctx, asset)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
 	if err != nil {
 		return nil, fmt.Errorf("release location request failed (%s)", err)
 	}
@@ -108,7 +183,7 @@ func (h *Github) Fetch(binStat *BinStat) (io.Reader, error) {
 	}
 	s3URL := resp.Header.Get("Location")
 	//pseudo-HEAD request
-	req, err = http.NewRequest("GET", s3URL, nil)
+	req, err = http.NewRequestWithContext(ctx, "GET", s3URL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("release location url error (%s)", err)
 	}
@@ -121,12 +196,17 @@ func (h *Github) Fetch(binStat *BinStat) (io.Reader, error) {
 	if resp.StatusCode != http.StatusPartialContent {
 		return nil, fmt.Errorf("release location request failed (status code %d)", resp.StatusCode)
 	}
-	etag := resp.Header.Get("ETag")
-	if etag != "" && h.lastETag == etag {
+	assetETag := resp.Header.Get("ETag")
+	if assetETag != "" && h.lastETag == assetETag {
+		checked()
 		return nil, nil //skip, hash match
 	}
-	//get binary request
-	resp, err = http.Get(s3URL)
+	//get binary request, the body is tied to ctx
+	resp, err = h.Download.get(ctx, func(ctx context.Context, header http.Header) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx, "GET", s3URL, nil)
+		req.Header = header
+		return http.DefaultClient.Do(req)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("release binary request failed (%s)", err)
 	}
@@ -134,11 +214,140 @@ func (h *Github) Fetch(binStat *BinStat) (io.Reader, error) {
 		resp.Body.Close()
 		return nil, fmt.Errorf("release binary request failed (status code %d)", resp.StatusCode)
 	}
-	h.lastETag = etag
+	//the release is only checked once its binary is received
+	body := completed(resp.Body, func() {
+		h.lastETag = assetETag
+		checked()
+	})
+	tagName := h.latestRelease.TagName
+	signature := func() ([]byte, error) {
+		return h.signature(ctx, tagName, sigAsset)
+	}
+	//decompress and extract archives
+	r, err := decode(body, asset.Name, h.Entry)
+	if err != nil {
+		return nil, err
+	}
 	//success!
-	//extract gz files
-	if strings.HasSuffix(assetURL, ".gz") && resp.Header.Get("Content-Encoding") != "gzip" {
-		return gzip.NewReader(resp.Body)
+	return WithVersion(WithSignature(r, signature), tagName), nil
+}
+
+// release updates the latest release, using the ETag of the
+// last checked release so unchanged releases aren't counted
+// against the rate limit. Returns the ETag of the release.
+func (h *Github) release(ctx context.Context) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", h.releaseURL, nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+	if h.releaseETag != "" {
+		req.Header.Set("If-None-Match", h.releaseETag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", false, fmt.Errorf("release info request failed (%s)", err)
+	}
+	defer resp.Body.Close()
+	if err := h.rateLimit(resp); err != nil {
+		return "", false, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return h.releaseETag, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("release info request failed (status code %d)", resp.StatusCode)
+	}
+	release := githubRelease{}
+	if strings.HasSuffix(h.releaseURL, "/latest") {
+		if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+			return "", false, fmt.Errorf("invalid request info (%s)", err)
+		}
+	} else {
+		releases := []githubRelease{}
+		if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+			return "", false, fmt.Errorf("invalid request info (%s)", err)
+		}
+		found := false
+		for _, r := range releases {
+			if h.follows(r) {
+				release, found = r, true
+				break
+			}
+		}
+		if !found {
+			return "", false, fmt.Errorf("no release matching tag %q", h.Tag)
+		}
+	}
+	h.latestRelease = release
+	return resp.Header.Get("ETag"), true, nil
+}
+
+// follows reports whether the release is followed, the
+// releases are listed newest first
+func (h *Github) follows(r githubRelease) bool {
+	if r.Draft || (r.Prerelease && !h.Prerelease) {
+		return false
+	}
+	if h.Tag == "" {
+		return true
+	}
+	ok, _ := path.Match(h.Tag, r.TagName)
+	return ok
+}
+
+// rateLimit stops requests until the rate limit resets
+func (h *Github) rateLimit(resp *http.Response) error {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		//secondary rate limit
+		h.limitedUntil = time.Now().Add(time.Duration(secs) * time.Second)
+	} else if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		h.limitedUntil = time.Unix(reset, 0)
+	} else {
+		return nil //forbidden
+	}
+	return errors.New("release info request rate limited until " + h.limitedUntil.Format(time.RFC3339))
+}
+
+// assetRequest requests an asset, authenticated requests
+// use the API URL which also works for private repositories
+func (h *Github) assetRequest(ctx context.Context, a *githubAsset) (*http.Request, error) {
+	if h.Token == "" {
+		return http.NewRequestWithContext(ctx, "GET", a.URL, nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", a.APIURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	req.Header.Set("Authorization", "Bearer "+h.Token)
+	return req, nil
+}
+
+// signature fetches the asset holding the detached signature,
+// it's expected to be named after the binary asset plus ".sig"
+func (h *Github) signature(ctx context.Context, tagName string, a *githubAsset) ([]byte, error) {
+	if a == nil {
+		return nil, fmt.Errorf("no signature asset in this release (%s)", tagName)
+	}
+	req, err := h.assetRequest(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	//the authorization header isn't sent on to the asset's location
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("release signature request failed (%s)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("release signature request failed (status code %d)", resp.StatusCode)
 	}
-	return resp.Body, nil
+	return readSignature(resp.Body)
 }
@@ -1,11 +1,10 @@
 package fetcher
 
 import (
-	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
 	"time"
 )
 
@@ -17,6 +16,14 @@ type HTTP struct {
 	URL          string
 	Interval     time.Duration
 	CheckHeaders []string
+	//SignatureURL of the detached signature of the
+	//binary, defaults to URL + ".sig"
+	SignatureURL string
+	//Download configures retries and progress
+	Download Download
+	//Entry is the binary extracted from archive assets,
+	//defaults to the base name of the executable
+	Entry string
 	//internal state
 	delay bool
 	lasts map[string]string
@@ -38,18 +45,34 @@ func (h *HTTP) Init() error {
 	if h.CheckHeaders == nil {
 		h.CheckHeaders = defaultHTTPCheckHeaders
 	}
+	if h.SignatureURL == "" {
+		h.SignatureURL = h.URL + signatureSuffix
+	}
+	if h.Entry == "" {
+		h.Entry = defaultEntry()
+	}
 	return nil
 }
 
-// Fetch the binary from the provided URL
+// Fetch the binary from the provided URL, every Interval
 func (h *HTTP) Fetch(binStat *BinStat) (io.Reader, error) {
 	//delay fetches after first
 	if h.delay {
 		time.Sleep(h.Interval)
 	}
 	h.delay = true
+	return h.FetchContext(context.Background(), binStat)
+}
+
+// FetchInterval is the Interval
+func (h *HTTP) FetchInterval() time.Duration {
+	return h.Interval
+}
+
+// FetchContext fetches the binary from the provided URL
+func (h *HTTP) FetchContext(ctx context.Context, binStat *BinStat) (io.Reader, error) {
 	//status check using HEAD
-	resp, err := http.Head(h.URL)
+	resp, err := h.request(ctx, "HEAD", h.URL)
 	if err != nil {
 		return nil, fmt.Errorf("HEAD request failed (%s)", err)
 	}
@@ -59,30 +82,69 @@ func (h *HTTP) Fetch(binStat *BinStat) (io.Reader, error) {
 	}
 	//if all headers match, skip update
 	matches, total := 0, 0
+	currs := map[string]string{}
 	for _, header := range h.CheckHeaders {
 		if curr := resp.Header.Get(header); curr != "" {
 			if last, ok := h.lasts[header]; ok && last == curr {
 				matches++
 			}
-			h.lasts[header] = curr
+			currs[header] = curr
 			total++
 		}
 	}
 	if matches == total {
 		return nil, nil //skip, file match
 	}
-	//binary fetch using GET
-	resp, err = http.Get(h.URL)
+	//binary fetch using GET, the body is tied to ctx
+	resp, err = h.Download.get(ctx, func(ctx context.Context, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", h.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header
+		return http.DefaultClient.Do(req)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("GET request failed (%s)", err)
 	}
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		return nil, fmt.Errorf("GET request failed (status code %d)", resp.StatusCode)
 	}
-	//extract gz files
-	if strings.HasSuffix(h.URL, ".gz") && resp.Header.Get("Content-Encoding") != "gzip" {
-		return gzip.NewReader(resp.Body)
+	//the headers are only matched once the binary is received
+	body := completed(resp.Body, func() {
+		for header, curr := range currs {
+			h.lasts[header] = curr
+		}
+	})
+	signature := func() ([]byte, error) {
+		return h.signature(ctx)
+	}
+	//decompress and extract archives
+	r, err := decode(body, h.URL, h.Entry)
+	if err != nil {
+		return nil, err
 	}
 	//success!
-	return resp.Body, nil
+	return WithSignature(r, signature), nil
+}
+
+func (h *HTTP) request(ctx context.Context, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (h *HTTP) signature(ctx context.Context) ([]byte, error) {
+	resp, err := h.request(ctx, "GET", h.SignatureURL)
+	if err != nil {
+		return nil, fmt.Errorf("signature request failed (%s)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signature request failed (status code %d)", resp.StatusCode)
+	}
+	return readSignature(resp.Body)
 }
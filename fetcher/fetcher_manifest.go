@@ -0,0 +1,284 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Manifest polls a JSON release manifest (see ManifestDocument)
+// describing the latest version of the binary for each platform.
+// When the version changes, it downloads the asset for this platform,
+// verifying its size and SHA-256 digest as it is streamed.
+type Manifest struct {
+	//URL of the JSON manifest
+	URL string
+	//Interval between manifest checks, defaults to 5 minutes
+	Interval time.Duration
+	//Platform selects the manifest asset, defaults to "GOOS/GOARCH"
+	Platform string
+	//Entry is the binary extracted from archive assets,
+	//defaults to the base name of the executable
+	Entry string
+	//internal state
+	delay     bool
+	etag      string
+	version   string
+	binDigest string
+}
+
+// ManifestDocument is the release manifest polled by the Manifest fetcher,
+// for example:
+//
+//	{
+//	  "version": "1.4.0",
+//	  "assets": {
+//	    "linux/amd64": {
+//	      "url": "myapp-1.4.0-linux-amd64",
+//	      "sha256": "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+//	      "size": 8123456
+//	    }
+//	  }
+//	}
+type ManifestDocument struct {
+	Version string `json:"version"`
+	//Assets by platform ("GOOS/GOARCH")
+	Assets map[string]ManifestAsset `json:"assets"`
+}
+
+// ManifestAsset is the download of one platform's binary
+type ManifestAsset struct {
+	//URL of the binary, relative URLs are resolved against the manifest URL
+	URL string `json:"url"`
+	//SHA256 is the hex encoded digest of the file at URL
+	SHA256 string `json:"sha256"`
+	//Size of the file at URL in bytes, optional
+	Size int64 `json:"size,omitempty"`
+	//Signature URL of the detached signature, defaults to URL + ".sig"
+	Signature string `json:"signature,omitempty"`
+}
+
+// Init validates the provided config
+func (m *Manifest) Init() error {
+	if m.URL == "" {
+		return fmt.Errorf("URL required")
+	}
+	if m.Interval == 0 {
+		m.Interval = 5 * time.Minute
+	}
+	if m.Platform == "" {
+		m.Platform = runtime.GOOS + "/" + runtime.GOARCH
+	}
+	if m.Entry == "" {
+		m.Entry = defaultEntry()
+	}
+	//digest of the running binary, in case its version is unknown
+	if p, _ := os.Executable(); p != "" {
+		if f, err := os.Open(p); err == nil {
+			h := sha256.New()
+			io.Copy(h, f)
+			f.Close()
+			m.binDigest = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	return nil
+}
+
+// Fetch the binary listed in the manifest, every Interval
+func (m *Manifest) Fetch(binStat *BinStat) (io.Reader, error) {
+	//delay fetches after first
+	if m.delay {
+		time.Sleep(m.Interval)
+	}
+	m.delay = true
+	return m.FetchContext(context.Background(), binStat)
+}
+
+// FetchInterval is the Interval
+func (m *Manifest) FetchInterval() time.Duration {
+	return m.Interval
+}
+
+// FetchContext fetches the binary listed in the manifest
+func (m *Manifest) FetchContext(ctx context.Context, binStat *BinStat) (io.Reader, error) {
+	doc, etag, err := m.fetchManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, nil //skip, manifest match
+	}
+	//the manifest is only checked again once it changes, after
+	//its binary is received or if it is already running
+	checked := func() {
+		m.etag = etag
+	}
+	if doc.Version == m.version || doc.Version == binStat.Version {
+		checked()
+		return nil, nil //skip, version match
+	}
+	asset, ok := doc.Assets[m.Platform]
+	if !ok {
+		return nil, fmt.Errorf("no %s asset in manifest version %s", m.Platform, doc.Version)
+	}
+	if asset.URL == "" || asset.SHA256 == "" {
+		return nil, fmt.Errorf("manifest %s asset requires url and sha256", m.Platform)
+	}
+	if strings.EqualFold(asset.SHA256, m.binDigest) {
+		m.version = doc.Version
+		checked()
+		return nil, nil //skip, already running this version
+	}
+	assetURL, err := m.resolve(asset.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid asset url (%s)", err)
+	}
+	signatureURL := assetURL + signatureSuffix
+	if asset.Signature != "" {
+		if signatureURL, err = m.resolve(asset.Signature); err != nil {
+			return nil, fmt.Errorf("invalid signature url (%s)", err)
+		}
+	}
+	//binary fetch using GET, the body is tied to ctx
+	req, err := http.NewRequestWithContext(ctx, "GET", assetURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET request failed (%s)", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET request failed (status code %d)", resp.StatusCode)
+	}
+	if asset.Size > 0 && resp.ContentLength >= 0 && resp.ContentLength != asset.Size {
+		resp.Body.Close()
+		return nil, fmt.Errorf("asset size %d does not match manifest size %d", resp.ContentLength, asset.Size)
+	}
+	mr := &manifestReader{
+		body:   resp.Body,
+		hash:   sha256.New(),
+		size:   asset.Size,
+		digest: strings.ToLower(asset.SHA256),
+		verified: func() {
+			//only skip this version once it has been fully received
+			m.version = doc.Version
+			checked()
+		},
+	}
+	//decompress and extract archives, the digest is of the asset
+	r, err := decode(&readCloser{Reader: mr, Closer: resp.Body}, assetURL, m.Entry)
+	if err != nil {
+		return nil, err
+	}
+	//success!
+	r = WithSignature(r, func() ([]byte, error) {
+		return m.signature(ctx, signatureURL)
+	})
+	return WithVersion(r, doc.Version), nil
+}
+
+// fetchManifest returns nil if the manifest is unchanged,
+// otherwise the manifest and its ETag
+func (m *Manifest) fetchManifest(ctx context.Context) (*ManifestDocument, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", m.URL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if m.etag != "" {
+		req.Header.Set("If-None-Match", m.etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("manifest request failed (%s)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("manifest request failed (status code %d)", resp.StatusCode)
+	}
+	doc := &ManifestDocument{}
+	if err := json.NewDecoder(resp.Body).Decode(doc); err != nil {
+		return nil, "", fmt.Errorf("invalid manifest (%s)", err)
+	}
+	if doc.Version == "" {
+		return nil, "", errors.New("invalid manifest (version required)")
+	}
+	return doc, resp.Header.Get("ETag"), nil
+}
+
+func (m *Manifest) resolve(ref string) (string, error) {
+	base, err := url.Parse(m.URL)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(u).String(), nil
+}
+
+func (m *Manifest) signature(ctx context.Context, signatureURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", signatureURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("signature request failed (%s)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signature request failed (status code %d)", resp.StatusCode)
+	}
+	return readSignature(resp.Body)
+}
+
+// manifestReader verifies the size and digest of
+// an asset, the final read fails on a mismatch
+type manifestReader struct {
+	body     io.Reader
+	hash     hash.Hash
+	n, size  int64
+	digest   string
+	verified func()
+}
+
+func (r *manifestReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	if r.size > 0 && r.n > r.size {
+		return n, fmt.Errorf("asset is larger than manifest size %d", r.size)
+	}
+	if err == io.EOF {
+		if r.size > 0 && r.n != r.size {
+			return n, fmt.Errorf("asset size %d does not match manifest size %d", r.n, r.size)
+		}
+		if digest := hex.EncodeToString(r.hash.Sum(nil)); digest != r.digest {
+			return n, fmt.Errorf("asset sha256 %s does not match manifest sha256 %s", digest, r.digest)
+		}
+		r.verified()
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,123 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// manifestServer serves a manifest listing the asset with the given
+// digest and size, and the asset body. A chunked asset is sent without
+// a Content-Length, so its size is only checked as it is read.
+func manifestServer(t *testing.T, digest string, size int64, body string, chunked bool) *Manifest {
+	doc := ManifestDocument{
+		Version: "1.1.0",
+		Assets: map[string]ManifestAsset{
+			"test/arch": {URL: "myapp", SHA256: digest, Size: size},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"m1"`)
+		if r.Header.Get("If-None-Match") == `"m1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode(doc)
+	})
+	mux.HandleFunc("/myapp", func(w http.ResponseWriter, r *http.Request) {
+		if chunked {
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, body)
+	})
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	m := &Manifest{URL: s.URL + "/manifest.json", Platform: "test/arch", Entry: "myapp"}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// fetchManifestAsset fetches and reads the asset, a nil
+// error with no update is returned as io.EOF
+func fetchManifestAsset(m *Manifest) (string, error) {
+	r, err := m.FetchContext(context.Background(), &BinStat{Version: "1.0.0"})
+	if err != nil {
+		return "", err
+	}
+	if r == nil {
+		return "", io.EOF
+	}
+	defer r.(io.Closer).Close()
+	b, err := io.ReadAll(r)
+	return string(b), err
+}
+
+func TestManifest(t *testing.T) {
+	const body = "selfup binary"
+	m := manifestServer(t, sha256Hex(body), int64(len(body)), body, false)
+	b, err := fetchManifestAsset(m)
+	if err != nil || b != body {
+		t.Fatalf("fetched %q (%v), want %q", b, err, body)
+	}
+	//once received, the manifest isn't fetched again until it changes
+	if _, err := fetchManifestAsset(m); err != io.EOF {
+		t.Fatalf("fetched the received version again (%v)", err)
+	}
+}
+
+// TestManifestMismatch fetches assets which don't match the manifest,
+// each is rejected and fetched again on the next check
+func TestManifestMismatch(t *testing.T) {
+	const body = "selfup binary"
+	tests := []struct {
+		name    string
+		digest  string
+		size    int64
+		chunked bool
+		//the Content-Length is checked before the asset is read
+		fetchErr string
+		readErr  string
+	}{
+		{"Content-Length", sha256Hex(body), 99, false, "asset size 13 does not match manifest size 99", ""},
+		{"short", sha256Hex(body), 99, true, "", "asset size 13 does not match manifest size 99"},
+		{"long", sha256Hex(body), 5, true, "", "asset is larger than manifest size 5"},
+		{"digest", sha256Hex("other binary"), int64(len(body)), false, "", "asset sha256 " + sha256Hex(body) + " does not match"},
+		{"digest without size", sha256Hex("other binary"), 0, true, "", "does not match manifest sha256"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := manifestServer(t, test.digest, test.size, body, test.chunked)
+			for i := 0; i < 2; i++ {
+				r, err := m.FetchContext(context.Background(), &BinStat{Version: "1.0.0"})
+				if test.fetchErr != "" {
+					if err == nil || !strings.Contains(err.Error(), test.fetchErr) {
+						t.Fatalf("fetch %d error %v, want %q", i+1, err, test.fetchErr)
+					}
+					continue
+				}
+				if err != nil || r == nil {
+					t.Fatalf("fetch %d got no asset (%v)", i+1, err)
+				}
+				_, err = io.ReadAll(r)
+				r.(io.Closer).Close()
+				if err == nil || !strings.Contains(err.Error(), test.readErr) {
+					t.Fatalf("read %d error %v, want %q", i+1, err, test.readErr)
+				}
+			}
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package fetcher
 
 import (
-	"compress/gzip"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
@@ -27,12 +27,21 @@ type S3 struct {
 	Region string
 	Bucket string
 	Key    string
+	//SignatureKey of the detached signature of the
+	//binary, defaults to Key + ".sig"
+	SignatureKey string
 	//Interval between checks
 	Interval time.Duration
 	//HeadTimeout defaults to 5 seconds
 	HeadTimeout time.Duration
-	//GetTimeout defaults to 5 minutes
+	//GetTimeout defaults to 5 minutes, for each request
+	//when the download is retried
 	GetTimeout time.Duration
+	//Download configures retries and progress
+	Download Download
+	//Entry is the binary extracted from archive assets,
+	//defaults to the base name of the executable
+	Entry string
 	//interal state
 	client   *http.Client
 	delay    bool
@@ -49,6 +58,12 @@ func (s *S3) Init() error {
 	if s.Region == "" {
 		s.Region = "ap-southeast-2"
 	}
+	if s.SignatureKey == "" {
+		s.SignatureKey = s.Key + signatureSuffix
+	}
+	if s.Entry == "" {
+		s.Entry = defaultEntry()
+	}
 	//initial etag
 	if p, _ := os.Executable(); p != "" {
 		if f, err := os.Open(p); err == nil {
@@ -71,31 +86,37 @@ func (s *S3) Init() error {
 	return nil
 }
 
-// Fetch the binary from S3
+// Fetch the binary from S3, every Interval
 func (s *S3) Fetch(binStat *BinStat) (io.Reader, error) {
 	//delay fetches after first
 	if s.delay {
 		time.Sleep(s.Interval)
 	}
 	s.delay = true
+	return s.FetchContext(context.Background(), binStat)
+}
+
+// FetchInterval is the Interval
+func (s *S3) FetchInterval() time.Duration {
+	return s.Interval
+}
+
+// FetchContext fetches the binary from S3
+func (s *S3) FetchContext(ctx context.Context, binStat *BinStat) (io.Reader, error) {
 	//http client where we change the timeout
 	c := http.Client{}
-	//options for this key
-	creds := s3.AmbientCredentials()
-	if s.Access != "" && s.Secret != "" {
-		creds = s3.Credentials(s.Access, s.Secret)
-	}
-	opts := []s3.Option{creds, s3.Region(s.Region), s3.Bucket(s.Bucket), s3.Key(s.Key)}
+	opts := s.options(s.Key)
 	//status check using HEAD
 	req, err := s3.NewRequest("HEAD", opts...)
 	if err != nil {
 		return nil, err
 	}
 	c.Timeout = s.HeadTimeout
-	resp, err := c.Do(req)
+	resp, err := c.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("HEAD request failed (%s)", err)
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("HEAD request failed (%s)", resp.Status)
 	}
@@ -103,24 +124,64 @@ func (s *S3) Fetch(binStat *BinStat) (io.Reader, error) {
 	if s.lastETag == etag {
 		return nil, nil //skip, file match
 	}
-	s.lastETag = etag
 	//binary fetch using GET
-	req, err = s3.NewRequest("GET", opts...)
-	if err != nil {
-		return nil, err
-	}
 	c.Timeout = s.GetTimeout
-	resp, err = c.Do(req)
+	resp, err = s.Download.get(ctx, func(ctx context.Context, header http.Header) (*http.Response, error) {
+		req, err := s3.NewRequest("GET", opts...)
+		if err != nil {
+			return nil, err
+		}
+		//range headers aren't signed
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		return c.Do(req.WithContext(ctx))
+	})
 	if err != nil {
 		return nil, fmt.Errorf("GET request failed (%s)", err)
 	}
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		return nil, fmt.Errorf("GET request failed (%s)", resp.Status)
 	}
-	//extract gz files
-	if strings.HasSuffix(s.Key, ".gz") && resp.Header.Get("Content-Encoding") != "gzip" {
-		return gzip.NewReader(resp.Body)
+	//the etag is only matched once the binary is received
+	body := completed(resp.Body, func() {
+		s.lastETag = etag
+	})
+	signature := func() ([]byte, error) {
+		return s.signature(ctx)
+	}
+	//decompress and extract archives
+	r, err := decode(body, s.Key, s.Entry)
+	if err != nil {
+		return nil, err
 	}
 	//success!
-	return resp.Body, nil
+	return WithSignature(r, signature), nil
+}
+
+func (s *S3) options(key string) []s3.Option {
+	//options for this key
+	creds := s3.AmbientCredentials()
+	if s.Access != "" && s.Secret != "" {
+		creds = s3.Credentials(s.Access, s.Secret)
+	}
+	return []s3.Option{creds, s3.Region(s.Region), s3.Bucket(s.Bucket), s3.Key(key)}
+}
+
+func (s *S3) signature(ctx context.Context) ([]byte, error) {
+	req, err := s3.NewRequest("GET", s.options(s.SignatureKey)...)
+	if err != nil {
+		return nil, err
+	}
+	c := http.Client{Timeout: s.HeadTimeout}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("signature request failed (%s)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signature request failed (%s)", resp.Status)
+	}
+	return readSignature(resp.Body)
 }
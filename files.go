@@ -0,0 +1,94 @@
+package selfup
+
+//files registered by a program are held by the master
+//and passed to each following program
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// RegisterFile asks the master process to keep a duplicate of f,
+// such as a memfd, a lock file or a long-lived connection, and pass
+// it to every following program as State.Files[name]. It replaces
+// any file previously registered with the same name. The master
+// keeps its duplicate open until UnregisterFile is called.
+func (s *State) RegisterFile(name string, f *os.File) error {
+	if s.channel == nil {
+		return errNoChannel
+	}
+	if name == "" {
+		return errors.New("file name required")
+	}
+	return s.channel.sendFile(channelMsg{Type: msgFile, Name: name}, f)
+}
+
+// UnregisterFile asks the master process to close its duplicate
+// of a registered file, following programs won't receive it
+func (s *State) UnregisterFile(name string) error {
+	if s.channel == nil {
+		return errNoChannel
+	}
+	return s.channel.send(channelMsg{Type: msgRemoveFile, Name: name})
+}
+
+func (mp *master) registerFile(name string, f *os.File) {
+	mp.filesMux.Lock()
+	defer mp.filesMux.Unlock()
+	if prev, ok := mp.files[name]; ok {
+		prev.Close()
+	}
+	if mp.files == nil {
+		mp.files = map[string]*os.File{}
+	}
+	mp.files[name] = f
+	mslog.Debug("registered file", "name", name)
+}
+
+func (mp *master) unregisterFile(name string) {
+	mp.filesMux.Lock()
+	defer mp.filesMux.Unlock()
+	if f, ok := mp.files[name]; ok {
+		f.Close()
+		delete(mp.files, name)
+		mslog.Debug("unregistered file", "name", name)
+	}
+}
+
+// registeredFiles lists the registered files by name,
+// filesMux must be held until they've been passed on
+func (mp *master) registeredFiles() ([]string, []*os.File) {
+	names := make([]string, 0, len(mp.files))
+	for name := range mp.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*os.File, len(names))
+	for i, name := range names {
+		files[i] = mp.files[name]
+	}
+	return names, files
+}
+
+// initFiles opens the registered files passed by
+// the master, they follow the socket descriptors
+func (sp *slave) initFiles() error {
+	sp.state.Files = map[string]*os.File{}
+	env := os.Getenv(envFiles)
+	if env == "" {
+		return nil
+	}
+	names := []string{}
+	if err := json.Unmarshal([]byte(env), &names); err != nil {
+		return fmt.Errorf("invalid %s", envFiles)
+	}
+	numFDs, _ := strconv.Atoi(os.Getenv(envNumFDs))
+	for i, name := range names {
+		sp.state.Files[name] = os.NewFile(uintptr(3+numFDs+i), name)
+	}
+	return nil
+}
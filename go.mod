@@ -5,7 +5,10 @@ go 1.21
 require (
 	github.com/StackExchange/wmi v0.0.0-20190523213315-cbe66965904d
 	github.com/jpillora/s3 v1.1.4
+	github.com/klauspost/compress v1.17.11
+	github.com/kr/binarydist v0.1.0
 	github.com/rainkfun/go-kit v0.1.0
+	github.com/ulikunitz/xz v0.5.12
 )
 
 require (
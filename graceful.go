@@ -27,12 +27,14 @@ type selfupListener struct {
 }
 
 func (l *selfupListener) Accept() (net.Conn, error) {
-	conn, err := l.Listener.(*net.TCPListener).AcceptTCP()
+	conn, err := l.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
-	conn.SetKeepAlive(true)                  // see http.tcpKeepAliveListener
-	conn.SetKeepAlivePeriod(3 * time.Minute) // see http.tcpKeepAliveListener
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)                  // see http.tcpKeepAliveListener
+		tc.SetKeepAlivePeriod(3 * time.Minute) // see http.tcpKeepAliveListener
+	}
 	uconn := selfupConn{
 		Conn:   conn,
 		wg:     &l.wg,
@@ -79,7 +81,10 @@ func (l *selfupListener) Close() error {
 
 func (l *selfupListener) File() *os.File {
 	// returns a dup(2) - FD_CLOEXEC flag *not* set
-	tl := l.Listener.(*net.TCPListener)
+	tl, ok := l.Listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil
+	}
 	fl, _ := tl.File()
 	return fl
 }
@@ -99,3 +104,49 @@ func (o selfupConn) Close() error {
 	}
 	return err
 }
+
+func newOverseerPacketConn(c net.PacketConn) *selfupPacketConn {
+	return &selfupPacketConn{
+		PacketConn: c,
+		released:   make(chan bool),
+	}
+}
+
+// datagram sockets have no connections to drain, once
+// released reads stop so the next program receives any
+// further datagrams, while writes (replies) still work
+type selfupPacketConn struct {
+	net.PacketConn
+	releaseOnce sync.Once
+	released    chan bool
+}
+
+func (c *selfupPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if c.isReleased() {
+		return 0, nil, net.ErrClosed
+	}
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err != nil && c.isReleased() {
+		err = net.ErrClosed
+	}
+	return n, addr, err
+}
+
+func (c *selfupPacketConn) isReleased() bool {
+	select {
+	case <-c.released:
+		return true
+	default:
+		return false
+	}
+}
+
+// non-blocking stop reading
+func (c *selfupPacketConn) release() {
+	c.releaseOnce.Do(func() {
+		close(c.released)
+		//unblock pending reads, the socket itself is shared
+		//with the next program so it must not be shut down
+		c.PacketConn.SetReadDeadline(time.Now())
+	})
+}
@@ -0,0 +1,74 @@
+package selfup
+
+//a handover carries state from the program being restarted
+//to the next program, the master brokers it over their channels
+
+import "errors"
+
+var errNoChannel = errors.New("no channel to the master process")
+
+// WriteHandover passes data, such as session tables or sequence
+// numbers, to the next program which reads it with ReadHandover.
+// Call it once, after GracefulShutdown, with the final state.
+func (s *State) WriteHandover(data []byte) error {
+	if s.channel == nil {
+		return errNoChannel
+	}
+	return s.channel.send(channelMsg{Type: msgHandover, Data: data})
+}
+
+// ReadHandover returns the data the previous program passed to
+// WriteHandover, or nil if there is none. It blocks until the
+// previous program has written its handover or exited. With
+// Config.ReadyTimeout, call Ready first, since the previous
+// program is only asked to shut down once this one is ready.
+func (s *State) ReadHandover() []byte {
+	if s.handoverDone == nil {
+		return nil
+	}
+	<-s.handoverDone
+	return s.handover
+}
+
+// brokerHandover sends the handover of the previous
+// program, if any, to the slave process once it's written
+func (mp *master) brokerHandover(prev, s *slaveProcess, c *channel) {
+	var data []byte
+	if prev != nil {
+		select {
+		case <-prev.handedOver:
+			data = prev.handover
+		case <-s.done:
+			return
+		}
+	}
+	if err := c.send(channelMsg{Type: msgHandover, Data: data}); err != nil {
+		mslog.Debug("failed to send handover", "slave-id", s.id, "err", err)
+	}
+}
+
+// readChannel is run in a goroutine, it handles
+// messages from the master until it exits
+func (sp *slave) readChannel() {
+	c := sp.state.channel
+	err := c.receive(func(msg channelMsg) {
+		switch msg.Type {
+		case msgHandover:
+			sp.handoverOnce.Do(func() {
+				sp.state.handover = msg.Data
+				close(sp.state.handoverDone)
+			})
+		case msgRollback:
+			select {
+			case sp.state.rollbacks <- string(msg.Data):
+			default:
+			}
+		default:
+			sslog.Debug("unknown channel message", "type", msg.Type)
+		}
+	})
+	sslog.Debug("channel closed", "err", err)
+	sp.handoverOnce.Do(func() {
+		close(sp.state.handoverDone)
+	})
+}
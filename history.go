@@ -0,0 +1,183 @@
+package selfup
+
+//the history keeps previous binaries in a store directory
+//next to the executable so they can be rolled back to
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rainkfun/selfup/control"
+)
+
+const historyFile = "history.json"
+
+// historyEntry is a binary in the store, newest first
+type historyEntry struct {
+	control.Binary
+	Sockets []socketSpec `json:"sockets,omitempty"`
+}
+
+// historyDir is the store directory, next to the executable by default
+func (mp *master) historyDir() string {
+	if mp.Config.HistoryDir != "" {
+		return mp.Config.HistoryDir
+	}
+	return mp.binPath + ".history"
+}
+
+func (mp *master) historyPath(digest string) string {
+	return filepath.Join(mp.historyDir(), digest+extension())
+}
+
+// loadHistory reads the store and records the current binary,
+// which is the first entry of the history
+func (mp *master) loadHistory() error {
+	if err := os.MkdirAll(mp.historyDir(), 0755); err != nil {
+		return fmt.Errorf("history store (%s)", err)
+	}
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	if b, err := os.ReadFile(filepath.Join(mp.historyDir(), historyFile)); err == nil {
+		if err := json.Unmarshal(b, &mp.history); err != nil {
+			mslog.Warn("ignoring invalid history", "err", err)
+			mp.history = nil
+		}
+	}
+	if len(mp.history) > 0 && mp.history[0].Hash == mp.binHash {
+		return nil
+	}
+	mp.recordHistory(mp.binHash, mp.binVersion, mp.binSockets, "initial")
+	return nil
+}
+
+// recordHistory stores the installed binary as the first entry
+// and prunes the oldest, upgradeMux must be held
+func (mp *master) recordHistory(digest, version string, sockets []socketSpec, source string) {
+	if mp.Config.History <= 0 {
+		return
+	}
+	path := mp.historyPath(digest)
+	if _, err := os.Stat(path); err != nil {
+		if err := copyFile(path, mp.binPath, mp.binPerms); err != nil {
+			mslog.Warn("failed to store binary in history", "err", err)
+			return
+		}
+	}
+	entries := []historyEntry{{
+		Binary: control.Binary{
+			Hash:        digest,
+			Version:     version,
+			InstalledAt: time.Now(),
+			Source:      source,
+		},
+		Sockets: sockets,
+	}}
+	for _, e := range mp.history {
+		switch {
+		case e.Hash == digest:
+			//moved to the front
+		case mp.badHashes[e.Hash]:
+			//rolled back from, never installed again
+			os.Remove(mp.historyPath(e.Hash))
+		default:
+			entries = append(entries, e)
+		}
+	}
+	//the current binary and the previous History binaries
+	keep := mp.Config.History + 1
+	for _, e := range entries[min(keep, len(entries)):] {
+		os.Remove(mp.historyPath(e.Hash))
+	}
+	mp.history = entries[:min(keep, len(entries))]
+	b, _ := json.MarshalIndent(mp.history, "", "  ")
+	if err := os.WriteFile(filepath.Join(mp.historyDir(), historyFile), b, 0644); err != nil {
+		mslog.Warn("failed to write history", "err", err)
+	}
+}
+
+// binaryHistory lists the stored binaries, newest first
+func (mp *master) binaryHistory() []control.Binary {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	bins := make([]control.Binary, len(mp.history))
+	for i, e := range mp.history {
+		bins[i] = e.Binary
+	}
+	return bins
+}
+
+// rollbackTo reinstalls the binary installed n upgrades ago and
+// gracefully restarts the program with it, the current binary
+// is refused by later fetches
+func (mp *master) rollbackTo(n int) error {
+	if mp.Config.History <= 0 {
+		return errors.New("history disabled")
+	}
+	if mp.restarting {
+		return errors.New("restart in progress")
+	}
+	mp.upgradeMux.Lock()
+	if n < 1 || n >= len(mp.history) {
+		mp.upgradeMux.Unlock()
+		return fmt.Errorf("no binary %d upgrades ago", n)
+	}
+	e := mp.history[n]
+	mp.upgradeMux.Unlock()
+	src := filepath.Join(os.TempDir(), "selfup-"+token()+"-rollback"+extension())
+	if err := copyFile(src, mp.historyPath(e.Hash), mp.binPerms); err != nil {
+		return err
+	}
+	//like a failed upgrade, the binary rolled back from isn't installed again
+	mp.upgradeMux.Lock()
+	prevHash := mp.binHash
+	mp.badHashes[prevHash] = true
+	mp.upgradeMux.Unlock()
+	if err := mp.install(src, e.Hash, e.Version, e.Sockets, "rollback"); err != nil {
+		mp.upgradeMux.Lock()
+		delete(mp.badHashes, prevHash)
+		mp.upgradeMux.Unlock()
+		os.Remove(src)
+		return err
+	}
+	mslog.Info("rolled back binary", "bin-hash", prevHash, "new-bin-hash", e.Hash, "version", e.Version)
+	mp.emit(RolledBackEvent{Hash: prevHash, RestoredHash: e.Hash, Reason: "rollback to " + strconv.Itoa(n) + " upgrades ago"})
+	mp.notify("STATUS=rolled back binary to " + mp.binDescription())
+	go mp.triggerRestart()
+	return nil
+}
+
+// serialises calls to Rollback from the program
+var rollbackMux sync.Mutex
+
+// Rollback reverts to the binary installed n upgrades ago (1 is the
+// previous binary) from the history kept with Config.History, and
+// gracefully restarts the program with it. The binary rolled back
+// from won't be installed again. It can only be called from a
+// program run by selfup.
+func Rollback(n int) error {
+	s := runningState
+	if s == nil || s.channel == nil {
+		return errNoChannel
+	}
+	rollbackMux.Lock()
+	defer rollbackMux.Unlock()
+	if err := s.channel.send(channelMsg{Type: msgRollback, Data: []byte(strconv.Itoa(n))}); err != nil {
+		return err
+	}
+	select {
+	case reply := <-s.rollbacks:
+		if reply != "" {
+			return errors.New(reply)
+		}
+		return nil
+	case <-time.After(30 * time.Second):
+		return errors.New("no reply from the master process")
+	}
+}
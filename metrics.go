@@ -0,0 +1,215 @@
+package selfup
+
+//metrics are collected from the master's lifecycle
+//events and exposed in the prometheus text format
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// histogram buckets in seconds
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+type metrics struct {
+	mut           sync.Mutex
+	fetcher       string
+	fetches       map[string]int64
+	fetchErrors   map[string]int64
+	downloadBytes int64
+	downloads     histogram
+	upgrades      int64
+	refused       int64
+	rollbacks     int64
+	restarts      int64
+	restartTimes  histogram
+	forcedKills   int64
+	drains        histogram
+	draining      map[int]time.Time
+	exits         map[bool]int64
+	crashRestarts int64
+	crashLoops    int64
+	droppedEvents int64
+}
+
+func newMetrics(fetcherType string) *metrics {
+	return &metrics{
+		fetcher:      fetcherType,
+		fetches:      map[string]int64{},
+		fetchErrors:  map[string]int64{},
+		downloads:    newHistogram(),
+		restartTimes: newHistogram(),
+		drains:       newHistogram(),
+		draining:     map[int]time.Time{},
+		exits:        map[bool]int64{},
+	}
+}
+
+// fetcherType is the metrics label of a fetcher, for example "http"
+func fetcherType(f interface{}) string {
+	t := fmt.Sprintf("%T", f)
+	if i := strings.LastIndexByte(t, '.'); i >= 0 {
+		t = t[i+1:]
+	}
+	return strings.ToLower(strings.TrimPrefix(t, "*"))
+}
+
+// observe updates the metrics with a lifecycle event
+func (m *metrics) observe(e Event) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	switch e := e.(type) {
+	case FetchStartedEvent:
+		m.fetches[m.fetcher]++
+	case FetchFailedEvent:
+		m.fetchErrors[m.fetcher]++
+	case DownloadFinishedEvent:
+		m.downloadBytes += e.Bytes
+		m.downloads.observe(e.Duration)
+	case UpgradeRefusedEvent, SanityCheckFailedEvent:
+		m.refused++
+	case BinaryReplacedEvent:
+		m.upgrades++
+	case RolledBackEvent:
+		m.rollbacks++
+	case RestartTriggeredEvent:
+		m.restarts++
+		m.draining[e.SlaveID] = time.Now()
+	case GracefulTimeoutEvent:
+		m.forcedKills++
+	case SlaveExitedEvent:
+		m.exits[e.Expected]++
+		if t, ok := m.draining[e.SlaveID]; ok {
+			delete(m.draining, e.SlaveID)
+			m.drains.observe(time.Since(t))
+		}
+	case CrashRestartEvent:
+		m.crashRestarts++
+	case CrashLoopEvent:
+		m.crashLoops++
+	}
+}
+
+// restarted records how long a graceful restart took,
+// from the restart signal until the next program took over
+func (m *metrics) restarted(d time.Duration) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.restartTimes.observe(d)
+}
+
+// droppedEvent counts an event the OnEvent queue had no room for
+func (m *metrics) droppedEvent() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.droppedEvents++
+}
+
+// write the metrics in the prometheus text format
+func (m *metrics) write(w io.Writer) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	p := &promWriter{w: w}
+	p.labelled("selfup_fetch_attempts_total", "counter", "Checks for a new binary.", "fetcher", m.fetches)
+	p.labelled("selfup_fetch_errors_total", "counter", "Checks for a new binary which failed.", "fetcher", m.fetchErrors)
+	p.value("selfup_download_bytes_total", "counter", "Bytes of new binaries downloaded.", m.downloadBytes)
+	p.histogram("selfup_download_duration_seconds", "Time taken to download new binaries.", &m.downloads)
+	p.value("selfup_upgrades_total", "counter", "New binaries installed.", m.upgrades)
+	p.value("selfup_upgrades_refused_total", "counter", "New binaries which were downloaded but not installed.", m.refused)
+	p.value("selfup_rollbacks_total", "counter", "Upgrades rolled back to the previous binary.", m.rollbacks)
+	p.value("selfup_restarts_total", "counter", "Graceful restarts of the program.", m.restarts)
+	p.histogram("selfup_restart_duration_seconds", "Time from a restart signal until the next program took over.", &m.restartTimes)
+	p.value("selfup_forced_kills_total", "counter", "Programs killed after TerminateTimeout.", m.forcedKills)
+	p.histogram("selfup_drain_duration_seconds", "Time from a restart signal until the previous program exited.", &m.drains)
+	exits := map[string]int64{"true": m.exits[true], "false": m.exits[false]}
+	p.labelled("selfup_slave_exits_total", "counter", "Program exits, by whether the master asked it to stop.", "expected", exits)
+	p.value("selfup_crash_restarts_total", "counter", "Programs restarted by the restart policy after exiting unexpectedly.", m.crashRestarts)
+	p.value("selfup_crash_loops_total", "counter", "Times the restart policy gave up on a crash looping program.", m.crashLoops)
+	p.value("selfup_events_dropped_total", "counter", "Events not passed to OnEvent because its queue was full.", m.droppedEvents)
+}
+
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newHistogram() histogram {
+	return histogram{counts: make([]int64, len(durationBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	for i, b := range durationBuckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += s
+}
+
+type promWriter struct {
+	w io.Writer
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) value(name, typ, help string, v int64) {
+	p.header(name, typ, help)
+	fmt.Fprintf(p.w, "%s %d\n", name, v)
+}
+
+func (p *promWriter) labelled(name, typ, help, label string, values map[string]int64) {
+	p.header(name, typ, help)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(p.w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+func (p *promWriter) histogram(name, help string, h *histogram) {
+	p.header(name, "histogram", help)
+	for i, b := range durationBuckets {
+		fmt.Fprintf(p.w, "%s_bucket{le=\"%g\"} %d\n", name, b, h.counts[i])
+	}
+	fmt.Fprintf(p.w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(p.w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(p.w, "%s_count %d\n", name, h.count)
+}
+
+func (mp *master) metricsText() string {
+	b := bytes.Buffer{}
+	mp.metrics.write(&b)
+	return b.String()
+}
+
+func (mp *master) serveMetrics() error {
+	l, err := net.Listen("tcp", mp.Config.MetricsAddress)
+	if err != nil {
+		return fmt.Errorf("metrics address %s (%s)", mp.Config.MetricsAddress, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		mp.metrics.write(w)
+	})
+	go func() {
+		err := http.Serve(l, mux)
+		mslog.Warn("metrics server closed", "err", err)
+	}()
+	return nil
+}
@@ -0,0 +1,21 @@
+package selfup
+
+import "fmt"
+
+// MoveError is returned, for example in a FetchFailedEvent, when a
+// binary could not be moved into place. Op is the step which failed,
+// such as "sync", "rename", "stage" or "copy".
+type MoveError struct {
+	Op  string
+	Src string
+	Dst string
+	Err error
+}
+
+func (e *MoveError) Error() string {
+	return fmt.Sprintf("move %s to %s: %s: %s", e.Src, e.Dst, e.Op, e.Err)
+}
+
+func (e *MoveError) Unwrap() error {
+	return e.Err
+}
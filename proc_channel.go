@@ -0,0 +1,108 @@
+package selfup
+
+//the channel is a socket connecting each slave process
+//to the master, it carries messages from the program
+//back to the master (e.g. when it has become ready) and
+//the handover from the previous program to the program
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	msgReady      = "ready"
+	msgReleased   = "released"
+	msgHandover   = "handover"
+	msgFile       = "file"
+	msgRemoveFile = "remove-file"
+	msgRollback   = "rollback"
+)
+
+// the most descriptors attached to a single read
+const maxChannelFiles = 16
+
+// a message sent over the channel
+type channelMsg struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	Data []byte `json:"data,omitempty"`
+	//file attached to a msgFile
+	file *os.File
+}
+
+type channel struct {
+	conn net.Conn
+	mut  sync.Mutex
+	enc  *json.Encoder
+	//received descriptors, waiting for their messages
+	files []*os.File
+}
+
+func newChannel(conn net.Conn) *channel {
+	return &channel{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+	}
+}
+
+func (c *channel) send(msg channelMsg) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.enc.Encode(msg)
+}
+
+// sendFile sends a message with a file descriptor attached
+func (c *channel) sendFile(msg channelMsg, f *os.File) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return writeWithFile(c.conn, append(b, '\n'), f)
+}
+
+// receive blocks, calling fn with each message
+// until the channel is closed
+func (c *channel) receive(fn func(channelMsg)) error {
+	defer func() {
+		for _, f := range c.files {
+			f.Close()
+		}
+	}()
+	dec := json.NewDecoder(channelReader{c})
+	for {
+		var msg channelMsg
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		//descriptors arrive with the first bytes of their
+		//message, so they're queued before it's decoded
+		if msg.Type == msgFile {
+			if len(c.files) == 0 {
+				continue
+			}
+			msg.file = c.files[0]
+			c.files = c.files[1:]
+		}
+		fn(msg)
+	}
+}
+
+// channelReader collects the descriptors attached to the stream
+type channelReader struct {
+	c *channel
+}
+
+func (r channelReader) Read(p []byte) (int, error) {
+	n, files, err := readWithFiles(r.c.conn, p)
+	r.c.files = append(r.c.files, files...)
+	return n, err
+}
+
+func (c *channel) Close() error {
+	return c.conn.Close()
+}
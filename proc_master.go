@@ -1,8 +1,11 @@
 package selfup
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -16,10 +19,12 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/rainkfun/go-kit/hash"
+	"github.com/rainkfun/selfup/control"
 	"github.com/rainkfun/selfup/fetcher"
 )
 
@@ -33,10 +38,13 @@ type master struct {
 	*Config
 	slaveID             int
 	slaveCmd            *exec.Cmd
-	slaveExtraFiles     []*os.File
+	nextSlave           *slaveProcess
+	sockets             []*masterSocket
+	binSockets          []socketSpec
 	binPath, tmpBinPath string
 	binPerms            os.FileMode
 	binHash             string
+	binVersion          string
 	restartMux          sync.Mutex
 	restarting          bool
 	restartedAt         time.Time
@@ -45,26 +53,87 @@ type master struct {
 	descriptorsReleased chan bool
 	signalledAt         time.Time
 	printCheckUpdate    bool
+	upgradeMux          sync.Mutex
+	upgrade             *upgrade
+	badHashes           map[string]bool
+	startedAt           time.Time
+	slave               *slaveProcess
+	checkNow            chan bool
+	statusMux           sync.Mutex
+	restarts            int
+	paused              bool
+	lastFetch           *control.Fetch
+	events              *eventQueue
+	metrics             *metrics
+	notifier            *notifier
+	filesMux            sync.Mutex
+	files               map[string]*os.File
+	supervisor          supervisor
+	backingOff          atomic.Bool
+	workers             []*slaveProcess
+	shutdown            chan bool
+	shutdownOnce        sync.Once
+	canary              atomic.Pointer[slaveProcess]
+	history             []historyEntry
+	fetcher             fetcher.ContextInterface
+	fetchCtx            context.Context
+	stopFetching        context.CancelFunc
 }
 
 func (mp *master) run() error {
 	mslog.Debug("run")
+	mp.startedAt = time.Now()
+	mp.supervisor.stop = make(chan os.Signal, 1)
+	mp.metrics = newMetrics(fetcherType(mp.Config.Fetcher))
+	if mp.Config.OnEvent != nil {
+		mp.events = newEventQueue(mp.Config.OnEvent)
+	}
 	if err := mp.checkBinary(); err != nil {
 		return err
 	}
+	if err := checkTLS(mp.Config); err != nil {
+		return err
+	}
+	if mp.Config.History > 0 {
+		if err := mp.loadHistory(); err != nil {
+			return err
+		}
+	}
+	if mp.Workers > 1 {
+		mp.newWorkers()
+	}
+	mp.fetchCtx, mp.stopFetching = context.WithCancel(context.Background())
 	if mp.Config.Fetcher != nil {
 		if err := mp.Config.Fetcher.Init(); err != nil {
 			mslog.Warn("fetcher init failed, fetcher disabled.", "err", err)
 			mp.Config.Fetcher = nil
+		} else {
+			mp.fetcher = fetcher.WithContext(mp.Config.Fetcher)
 		}
 	}
+	mp.notifier = newNotifier()
+	mp.watchdog()
 	mp.setupSignalling()
 	if err := mp.retreiveFileDescriptors(); err != nil {
 		return err
 	}
+	if mp.Config.ControlSocket != "" {
+		if err := mp.serveControl(); err != nil {
+			return err
+		}
+	}
+	if mp.Config.MetricsAddress != "" {
+		if err := mp.serveMetrics(); err != nil {
+			return err
+		}
+	}
 	if mp.Config.Fetcher != nil {
 		mp.printCheckUpdate = true
 		mp.fetch()
+		if mp.fetchCtx.Err() != nil {
+			mslog.Debug("stopped during the first fetch")
+			return nil
+		}
 		go mp.fetchLoop()
 	}
 	return mp.forkLoop()
@@ -94,6 +163,8 @@ func (mp *master) checkBinary() error {
 		return fmt.Errorf("cannot hash binary (%s)", err)
 	}
 	mp.binHash = digest
+	mp.binVersion = mp.Config.Version
+	mp.badHashes = map[string]bool{}
 	//test bin<->tmpbin moves
 	if mp.Config.Fetcher != nil {
 		if err := move(tmpBinPath, mp.binPath); err != nil {
@@ -110,6 +181,7 @@ func (mp *master) setupSignalling() {
 	//updater-forker comms
 	mp.restarted = make(chan bool)
 	mp.descriptorsReleased = make(chan bool)
+	mp.checkNow = make(chan bool, 1)
 	//read all master process signals
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals)
@@ -121,12 +193,18 @@ func (mp *master) setupSignalling() {
 }
 
 func (mp *master) handleSignal(s os.Signal) {
+	if s == os.Interrupt || s == syscall.SIGTERM {
+		//stopping, abort any download
+		mp.stopFetching()
+	}
 	switch {
 	case s == mp.RestartSignal:
 		// user initiated manual restart
 		go mp.triggerRestart()
 	case s.String() == "child exited":
 		// will occur on every restart, ignore it
+	case mp.Workers > 1:
+		mp.signalWorkers(s)
 	case mp.awaitingUSR1 && s == syscall.SIGUSR1:
 		//**during a restart** a SIGUSR1 signals
 		//to the master process that, the file
@@ -134,15 +212,28 @@ func (mp *master) handleSignal(s os.Signal) {
 		mslog.Debug("signaled, sockets ready")
 		mp.awaitingUSR1 = false
 		mp.descriptorsReleased <- true
+	case mp.backingOff.Load() && (s == os.Interrupt || s == syscall.SIGTERM):
+		//waiting to restart a crashed program, stop instead
+		select {
+		case mp.supervisor.stop <- s:
+		default:
+		}
 	case mp.slaveCmd != nil && mp.slaveCmd.Process != nil:
 		//while the slave process is running, proxy
 		//all signals through
 		mslog.Debug("proxy signal", "signal", s)
+		if s == os.Interrupt || s == syscall.SIGTERM {
+			if sp := mp.currentSlave(); sp != nil {
+				sp.stopping.Store(true)
+			}
+			mp.signalCanary(s)
+			mp.notify("STOPPING=1")
+		}
 		mp.sendSignal(s)
 	case s == os.Interrupt:
 		//otherwise if not running, kill on CTRL+c
 		mslog.Debug("interrupt with no slave")
-		os.Exit(1)
+		mp.exit(1)
 	default:
 		mslog.Debug("signal discarded, no slave process", "signal", s)
 	}
@@ -157,44 +248,178 @@ func (mp *master) sendSignal(s os.Signal) {
 	}
 }
 
+// currentSlave returns the active slave process, if any
+func (mp *master) currentSlave() *slaveProcess {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	return mp.slave
+}
+
+// a socket held by the master and passed to each slave
+type masterSocket struct {
+	fdInfo
+	file *os.File
+}
+
 func (mp *master) retreiveFileDescriptors() error {
-	mp.slaveExtraFiles = make([]*os.File, len(mp.Config.Addresses))
-	for i, addr := range mp.Config.Addresses {
-		a, err := net.ResolveTCPAddr("tcp", addr)
+	mp.binSockets = mp.Config.socketSpecs()
+	//sockets from systemd socket activation are used when they match
+	activated := activatedFiles()
+	for _, spec := range mp.binSockets {
+		network, f := adoptFile(activated, spec)
+		if f == nil {
+			var err error
+			if network, f, err = mp.listenFile(spec.Address); err != nil {
+				return err
+			}
+		}
+		mp.sockets = append(mp.sockets, &masterSocket{
+			fdInfo: fdInfo{socketSpec: spec, Network: network},
+			file:   f,
+		})
+	}
+	for _, af := range activated {
+		if af != nil {
+			mslog.Warn("activated socket matches no address, closing", "name", af.name)
+			af.file.Close()
+		}
+	}
+	return nil
+}
+
+// reconcileSockets updates the sockets passed to slaves when
+// the installed binary declares a different set. Unchanged
+// addresses keep their socket, removed ones are closed once
+// the previous slave has exited.
+func (mp *master) reconcileSockets() {
+	mp.upgradeMux.Lock()
+	specs := mp.binSockets
+	mp.upgradeMux.Unlock()
+	current := make([]socketSpec, len(mp.sockets))
+	existing := map[string]*masterSocket{}
+	for i, ms := range mp.sockets {
+		current[i] = ms.socketSpec
+		existing[ms.Address] = ms
+	}
+	if sameSockets(specs, current) {
+		return
+	}
+	next := make([]*masterSocket, 0, len(specs))
+	opened := []*masterSocket{}
+	for _, spec := range specs {
+		if ms, ok := existing[spec.Address]; ok {
+			delete(existing, spec.Address)
+			next = append(next, &masterSocket{
+				fdInfo: fdInfo{socketSpec: spec, Network: ms.Network},
+				file:   ms.file,
+			})
+			continue
+		}
+		network, f, err := mp.listenFile(spec.Address)
 		if err != nil {
-			return fmt.Errorf("Invalid address %s (%s)", addr, err)
+			mslog.Warn("failed to open new address, keeping previous addresses", "name", spec.Name, "err", err)
+			for _, ms := range opened {
+				ms.file.Close()
+			}
+			return
 		}
-		l, err := net.ListenTCP("tcp", a)
+		ms := &masterSocket{fdInfo: fdInfo{socketSpec: spec, Network: network}, file: f}
+		opened = append(opened, ms)
+		next = append(next, ms)
+		mslog.Info("opened new address", "name", spec.Name, "address", spec.Address)
+	}
+	mp.sockets = next
+	if len(existing) == 0 {
+		return
+	}
+	//the previous slave may still be draining removed sockets
+	prev := mp.currentSlave()
+	go func() {
+		if prev != nil {
+			<-prev.done
+		}
+		for _, ms := range existing {
+			mslog.Info("closing removed address", "name", ms.Name, "address", ms.Address)
+			ms.file.Close()
+			if ms.Network == "unix" || ms.Network == "unixgram" {
+				_, path, _ := parseAddress(ms.Address)
+				os.Remove(path)
+			}
+		}
+	}()
+}
+
+// listenFile opens the socket of a Config.Addresses
+// entry and returns its file, to be passed to slaves
+func (mp *master) listenFile(addr string) (string, *os.File, error) {
+	network, address, err := parseAddress(addr)
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid address %s (%s)", addr, err)
+	}
+	var l interface {
+		File() (*os.File, error)
+		Close() error
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+		a, err := net.ResolveUDPAddr(network, address)
 		if err != nil {
-			return err
+			return "", nil, fmt.Errorf("Invalid address %s (%s)", addr, err)
 		}
-		f, err := l.File()
+		if l, err = net.ListenUDP(network, a); err != nil {
+			return "", nil, err
+		}
+	case "unix", "unixgram":
+		if err := removeStaleSocket(network, address); err != nil {
+			return "", nil, fmt.Errorf("Invalid address %s (%s)", addr, err)
+		}
+		a := &net.UnixAddr{Name: address, Net: network}
+		if network == "unix" {
+			ul, err := net.ListenUnix(network, a)
+			if err != nil {
+				return "", nil, err
+			}
+			//the socket file must outlive this listener
+			ul.SetUnlinkOnClose(false)
+			l = ul
+		} else if l, err = net.ListenUnixgram(network, a); err != nil {
+			return "", nil, err
+		}
+		if err := mp.socketPerms(address); err != nil {
+			l.Close()
+			return "", nil, fmt.Errorf("Invalid address %s (%s)", addr, err)
+		}
+	default:
+		a, err := net.ResolveTCPAddr(network, address)
 		if err != nil {
-			return fmt.Errorf("Failed to retreive fd for: %s (%s)", addr, err)
+			return "", nil, fmt.Errorf("Invalid address %s (%s)", addr, err)
 		}
-		if err := l.Close(); err != nil {
-			return fmt.Errorf("Failed to close listener for: %s (%s)", addr, err)
+		if l, err = net.ListenTCP(network, a); err != nil {
+			return "", nil, err
 		}
-		mp.slaveExtraFiles[i] = f
 	}
-	return nil
+	f, err := l.File()
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to retreive fd for: %s (%s)", addr, err)
+	}
+	if err := l.Close(); err != nil {
+		return "", nil, fmt.Errorf("Failed to close listener for: %s (%s)", addr, err)
+	}
+	return network, f, nil
 }
 
-// fetchLoop is run in a goroutine
+// fetchLoop is run in a goroutine, it fetches every
+// fetcher interval, but no sooner than MinFetchInterval
 func (mp *master) fetchLoop() {
-	min := mp.Config.MinFetchInterval
-	time.Sleep(min)
+	interval := max(mp.fetcher.FetchInterval(), mp.Config.MinFetchInterval)
 	for {
-		t0 := time.Now()
-		mp.fetch()
-		//duration fetch of fetch
-		diff := time.Now().Sub(t0)
-		if diff < min {
-			delay := min - diff
-			//ensures at least MinFetchInterval delay.
-			//should be throttled by the fetcher!
-			time.Sleep(delay)
+		select {
+		case <-time.After(interval):
+		case <-mp.checkNow:
+		case <-mp.fetchCtx.Done():
+			return
 		}
+		mp.fetch()
 	}
 }
 
@@ -202,15 +427,24 @@ func (mp *master) fetch() {
 	if mp.restarting {
 		return //skip if restarting
 	}
+	if mp.updatesPaused() {
+		return //skip if paused by the operator
+	}
 	if mp.printCheckUpdate {
 		mslog.Info("checking for updates...")
 	}
+	mp.emit(FetchStartedEvent{})
 	binStat := &fetcher.BinStat{
-		Hash: mp.binHash,
+		Hash:    mp.binHash,
+		Version: mp.binVersion,
+	}
+	reader, err := mp.fetcher.FetchContext(mp.fetchCtx, binStat)
+	if err != nil && mp.fetchCtx.Err() != nil {
+		mslog.Debug("fetch cancelled")
+		return
 	}
-	reader, err := mp.Fetcher.Fetch(binStat)
 	if err != nil {
-		mslog.Warn("failed to get latest version", "err", err)
+		mp.fetchFailed(FetchFailedEvent{Err: err}, "failed to get latest version", "err", err)
 		return
 	}
 	if reader == nil {
@@ -218,17 +452,32 @@ func (mp *master) fetch() {
 			mslog.Info("no updates")
 		}
 		mp.printCheckUpdate = false
+		mp.recordFetch(control.FetchNoUpdate, "")
+		mp.emit(NoUpdateEvent{})
 		return //fetcher has explicitly said there are no updates
 	}
 	mp.printCheckUpdate = true
-	mslog.Debug("streaming update...")
+	//optional detached signature
+	signed, _ := reader.(fetcher.Signed)
 	//optional closer
 	if closer, ok := reader.(io.Closer); ok {
 		defer closer.Close()
 	}
+	//optional version, refuse downgrades before downloading
+	version := ""
+	if v, ok := reader.(fetcher.Versioned); ok {
+		version = v.Version()
+	}
+	if version != "" && !mp.AllowDowngrade {
+		if cmp, ok := compareVersions(version, mp.binVersion); ok && cmp < 0 {
+			mp.fetchFailed(UpgradeRefusedEvent{Version: version, Reason: "downgrade"}, "refusing downgrade", "version", mp.binVersion, "new-version", version)
+			return
+		}
+	}
+	mslog.Debug("streaming update...", "new-version", version)
 	tmpBin, err := os.OpenFile(tmpBinPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		mslog.Warn("failed to open temp binary", "err", err)
+		mp.fetchFailed(FetchFailedEvent{Err: err}, "failed to open temp binary", "err", err)
 		return
 	}
 	defer func() {
@@ -237,41 +486,73 @@ func (mp *master) fetch() {
 	}()
 	//tee off to sha1
 	hash := hash.NewXXH64()
-	reader = io.TeeReader(reader, hash)
 	//write to a temp file
-	_, err = io.Copy(tmpBin, reader)
+	t0 := time.Now()
+	n, err := mp.download(reader, tmpBin, hash)
+	if err != nil && mp.fetchCtx.Err() != nil {
+		mslog.Debug("download cancelled", "bytes", n)
+		tmpBin.Close()
+		os.Remove(tmpBinPath)
+		return
+	}
 	if err != nil {
-		mslog.Warn("failed to write temp binary", "err", err)
+		mp.fetchFailed(FetchFailedEvent{Err: err}, "failed to write temp binary", "err", err)
 		return
 	}
 	//compare hash
 	s := hash.Sum64()
 	digest := fmt.Sprintf("%x", s)
+	mp.emit(DownloadFinishedEvent{Hash: digest, Version: version, Bytes: n, Duration: time.Since(t0)})
 	if mp.binHash == digest {
 		mslog.Debug("hash match - skip")
+		mp.recordFetch(control.FetchNoUpdate, "")
+		mp.emit(NoUpdateEvent{})
+		return
+	}
+	if mp.isBadHash(digest) {
+		mslog.Debug("hash previously rolled back - skip", "new-bin-hash", digest)
+		mp.recordFetch(control.FetchSkipped, "hash previously rolled back")
+		mp.emit(UpgradeRefusedEvent{Hash: digest, Version: version, Reason: "previously rolled back"})
 		return
 	}
 	//copy permissions
 	if err := chmod(tmpBin, mp.binPerms); err != nil {
-		mslog.Warn("failed to make temp binary executable", "err", err)
+		mp.fetchFailed(FetchFailedEvent{Err: err}, "failed to make temp binary executable", "err", err)
 		return
 	}
 	if err := chown(tmpBin, uid, gid); err != nil {
-		mslog.Warn("failed to change owner of binary", "err", err)
+		mp.fetchFailed(FetchFailedEvent{Err: err}, "failed to change owner of binary", "err", err)
 		return
 	}
 	if _, err := tmpBin.Stat(); err != nil {
-		mslog.Warn("failed to stat temp binary", "err", err)
+		mp.fetchFailed(FetchFailedEvent{Err: err}, "failed to stat temp binary", "err", err)
 		return
 	}
 	tmpBin.Close()
 	if _, err := os.Stat(tmpBinPath); err != nil {
-		mslog.Warn("failed to stat temp binary by path", "err", err)
+		mp.fetchFailed(FetchFailedEvent{Err: err}, "failed to stat temp binary by path", "err", err)
 		return
 	}
+	//dont run the binary or install it unless it is signed
+	if mp.Config.Verifier != nil {
+		if signed == nil {
+			mp.fetchFailed(UpgradeRefusedEvent{Hash: digest, Version: version, Reason: "no signature"}, "fetcher provides no signature, upgrade refused")
+			return
+		}
+		signature, err := signed.Signature()
+		if err != nil {
+			mp.fetchFailed(UpgradeRefusedEvent{Hash: digest, Version: version, Reason: err.Error()}, "failed to get signature, upgrade refused", "err", err)
+			return
+		}
+		if err := mp.Config.Verifier.Verify(tmpBinPath, signature); err != nil {
+			mp.fetchFailed(UpgradeRefusedEvent{Hash: digest, Version: version, Reason: err.Error()}, "signature verification failed, upgrade refused", "err", err)
+			return
+		}
+		mslog.Debug("signature verified", "new-bin-hash", digest)
+	}
 	if mp.Config.PreUpgrade != nil {
 		if err := mp.Config.PreUpgrade(tmpBinPath); err != nil {
-			mslog.Warn("user cancelled upgrade", "err", err)
+			mp.fetchFailed(UpgradeRefusedEvent{Hash: digest, Version: version, Reason: err.Error()}, "user cancelled upgrade", "err", err)
 			return
 		}
 	}
@@ -293,20 +574,55 @@ func (mp *master) fetch() {
 	tokenOut, err := cmd.CombinedOutput()
 	returned = true
 	if err != nil {
-		mslog.Warn("failed to run temp binary", "err", err, "tmp-bin-path", tmpBinPath, "output", tokenOut)
+		mp.fetchFailed(SanityCheckFailedEvent{Hash: digest, Err: err}, "failed to run temp binary", "err", err, "tmp-bin-path", tmpBinPath, "output", tokenOut)
 		return
 	}
 	if !strings.Contains(string(tokenOut), tokenIn) {
-		mslog.Warn("sanity check failed", "token-in", tokenIn, "token-out", tokenOut)
+		mp.fetchFailed(SanityCheckFailedEvent{Hash: digest, Err: errors.New("token mismatch")}, "sanity check failed", "token-in", tokenIn, "token-out", tokenOut)
 		return
 	}
+	//the new binary may listen on different addresses
+	sockets, _ := parseSanitySockets(tokenOut)
+	//without a version from the fetcher, use the one the new binary reports
+	if version == "" {
+		version = parseSanityVersion(tokenOut)
+		if version != "" && !mp.AllowDowngrade {
+			if cmp, ok := compareVersions(version, mp.binVersion); ok && cmp < 0 {
+				mp.fetchFailed(UpgradeRefusedEvent{Hash: digest, Version: version, Reason: "downgrade"}, "refusing downgrade", "version", mp.binVersion, "new-version", version)
+				return
+			}
+		}
+	}
+	//try the new binary alongside the current program first
+	if mp.Canary > 0 {
+		if sockets != nil && !sameSockets(sockets, mp.binSockets) {
+			//a canary shares the current sockets, so it can't try these
+			mp.fetchFailed(UpgradeRefusedEvent{Hash: digest, Version: version, Reason: "canary can't run on different sockets"}, "new binary declares different sockets, upgrade refused", "new-bin-hash", digest)
+			return
+		}
+		if err := mp.runCanary(digest, version); err != nil {
+			mp.refuseCanary(digest)
+			mp.fetchFailed(UpgradeRefusedEvent{Hash: digest, Version: version, Reason: "canary " + err.Error()}, "canary failed, upgrade refused", "err", err)
+			return
+		}
+	}
 	//overwrite!
-	if err := overwrite(mp.binPath, tmpBinPath); err != nil {
-		mslog.Warn("failed to overwrite binary", "err", err)
+	prevHash, prevVersion := mp.binHash, mp.binVersion
+	if version == "" {
+		//unknown, keep the current one so downgrades are still refused
+		version = prevVersion
+	}
+	if err := mp.install(tmpBinPath, digest, version, sockets, fetcherType(mp.Config.Fetcher)); err != nil {
+		mp.fetchFailed(FetchFailedEvent{Err: err}, "failed to overwrite binary", "err", err)
 		return
 	}
-	mslog.Info("upgraded binary", "bin-hash", mp.binHash, "new-bin-hash", digest)
-	mp.binHash = digest
+	mslog.Info("upgraded binary", "bin-hash", prevHash, "new-bin-hash", digest, "version", prevVersion, "new-version", version)
+	mp.recordFetch(control.FetchUpgraded, "")
+	mp.emit(BinaryReplacedEvent{PrevHash: prevHash, Hash: digest, PrevVersion: prevVersion, Version: version})
+	mp.notify("STATUS=upgraded binary to " + mp.binDescription())
+	if mp.Config.PostUpgrade != nil {
+		mp.Config.PostUpgrade(mp.binPath)
+	}
 	//binary successfully replaced
 	if !mp.Config.NoRestartAfterFetch {
 		mp.triggerRestart()
@@ -316,6 +632,10 @@ func (mp *master) fetch() {
 }
 
 func (mp *master) triggerRestart() {
+	if mp.Workers > 1 {
+		mp.rollingRestart()
+		return
+	}
 	if mp.restarting {
 		mslog.Debug("already graceful restarting")
 		return //skip
@@ -324,10 +644,30 @@ func (mp *master) triggerRestart() {
 		return //skip
 	}
 	mslog.Debug("graceful restart triggered")
+	mp.restartMux.Lock()
 	mp.restarting = true
+	mp.notify("RELOADING=1", "STATUS=restarting")
+	if mp.ReadyTimeout > 0 && !mp.NoRestart {
+		//start the next program while the current one is still
+		//serving, only drain the current one once it's ready
+		if !mp.startNext() {
+			mp.restarting = false
+			mp.restartMux.Unlock()
+			if prev := mp.currentSlave(); prev != nil {
+				mp.notifyReady(prev)
+			}
+			return
+		}
+	}
 	mp.awaitingUSR1 = true
 	mp.signalledAt = time.Now()
+	prev := mp.currentSlave()
+	if prev != nil {
+		prev.stopping.Store(true)
+		mp.emit(RestartTriggeredEvent{SlaveID: prev.id, PID: prev.cmd.Process.Pid})
+	}
 	mp.sendSignal(mp.Config.RestartSignal) //ask nicely to terminate
+	mp.restartMux.Unlock()
 	select {
 	case <-mp.restarted:
 		//success
@@ -335,12 +675,45 @@ func (mp *master) triggerRestart() {
 	case <-time.After(mp.TerminateTimeout):
 		//times up mr. process, we did ask nicely!
 		mslog.Debug("graceful timeout, forcing exit")
+		if prev != nil {
+			mp.emit(GracefulTimeoutEvent{SlaveID: prev.id, PID: prev.cmd.Process.Pid, Timeout: mp.TerminateTimeout})
+		}
 		mp.sendSignal(os.Kill)
 	}
 }
 
+// startNext starts the next slave process alongside the current one
+// and waits for it to become ready. Returns false if it never does,
+// in which case the current slave process is left running.
+func (mp *master) startNext() bool {
+	s, err := mp.startSlave(0)
+	if err != nil {
+		mslog.Warn("failed to start next slave process", "err", err)
+		return false
+	}
+	select {
+	case <-s.ready:
+		mslog.Debug("next slave ready", "slave-id", s.id)
+		mp.nextSlave = s
+		return true
+	case <-s.done:
+		mslog.Warn("next slave exited before becoming ready", "slave-id", s.id, "err", s.err)
+	case <-time.After(mp.ReadyTimeout):
+		mslog.Warn("next slave not ready in time, killing it", "slave-id", s.id, "ready-timeout", mp.ReadyTimeout)
+		s.stopping.Store(true)
+		s.cmd.Process.Kill()
+	}
+	if s.upgrade != nil && mp.rollback(s.upgrade, "not ready") {
+		mslog.Warn("upgraded program failed to become ready, rolled back")
+	}
+	return false
+}
+
 // not a real fork
 func (mp *master) forkLoop() error {
+	if mp.Workers > 1 {
+		return mp.workerLoop()
+	}
 	//loop, restart command
 	for {
 		if err := mp.fork(); err != nil {
@@ -350,62 +723,74 @@ func (mp *master) forkLoop() error {
 }
 
 func (mp *master) fork() error {
-	mslog.Debug("starting", "bin-path", mp.binPath)
-	cmd := exec.Command(mp.binPath)
+	mp.restartMux.Lock()
+	//the next slave may have already been started by a restart
+	s := mp.nextSlave
+	mp.nextSlave = nil
+	if s == nil {
+		var err error
+		if s, err = mp.startSlave(0); err != nil {
+			mp.restartMux.Unlock()
+			return err
+		}
+	}
 	//mark this new process as the "active" slave process.
 	//this process is assumed to be holding the socket files.
-	mp.slaveCmd = cmd
-	mp.slaveID++
-	//provide the slave process with some state
-	e := os.Environ()
-	e = append(e, envBinID+"="+mp.binHash)
-	e = append(e, envBinPath+"="+mp.binPath)
-	e = append(e, envSlaveID+"="+strconv.Itoa(mp.slaveID))
-	e = append(e, envIsSlave+"=1")
-	e = append(e, envNumFDs+"="+strconv.Itoa(len(mp.slaveExtraFiles)))
-	cmd.Env = e
-	//inherit master args/stdfiles
-	cmd.Args = os.Args
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	//include socket files
-	cmd.ExtraFiles = mp.slaveExtraFiles
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("Failed to start slave process: %s", err)
-	}
+	mp.slaveCmd = s.cmd
+	mp.restartMux.Unlock()
+	mp.statusMux.Lock()
+	if mp.slave != nil {
+		mp.restarts++
+	}
+	mp.slave = s
+	mp.statusMux.Unlock()
+	go func() {
+		if mp.ReadyTimeout > 0 {
+			select {
+			case <-s.ready:
+			case <-s.done:
+				return
+			}
+		}
+		mp.notifyReady(s)
+	}()
 	//was scheduled to restart, notify success
 	if mp.restarting {
 		mp.restartedAt = time.Now()
+		mp.metrics.restarted(mp.restartedAt.Sub(mp.signalledAt))
 		mp.restarting = false
 		mp.restarted <- true
 	}
-	//convert wait into channel
-	cmdwait := make(chan error)
-	go func() {
-		cmdwait <- cmd.Wait()
-	}()
 	//wait....
 	select {
-	case err := <-cmdwait:
+	case <-s.done:
 		//program exited before releasing descriptors
 		//proxy exit code out to master
-		code := 0
-		if err != nil {
-			code = 1
-			if exiterr, ok := err.(*exec.ExitError); ok {
-				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-					code = status.ExitStatus()
-				}
+		code := exitCode(s.err)
+		mslog.Debug("prog exited", "exit-code", code)
+		//an upgraded program which dies while on probation is
+		//replaced by the previous binary, unless it was stopped
+		if !mp.restarting && !s.stopping.Load() && s.upgrade != nil && mp.rollback(s.upgrade, "exited during probation") {
+			mslog.Warn("upgraded program exited during probation, rolled back", "exit-code", code)
+			if !mp.NoRestart {
+				return nil
 			}
 		}
-		mslog.Debug("prog exited", "exit-code", code)
 		//if a restarts are disabled or if it was an
 		//unexpected crash, proxy this exit straight
-		//through to the main process
+		//through to the main process, unless the
+		//RestartPolicy starts the program again
 		if mp.NoRestart || !mp.restarting {
-			os.Exit(code)
+			if !s.stopping.Load() && mp.restartCrashed(s, code) {
+				return nil
+			}
+			mp.exit(code)
 		}
+		//no longer expecting this program to signal
+		mp.awaitingUSR1 = false
+	case <-s.released:
+		//released sockets over the channel, see below
+		mp.awaitingUSR1 = false
 	case <-mp.descriptorsReleased:
 		//if descriptors are released, the program
 		//has yielded control of its sockets and
@@ -418,6 +803,199 @@ func (mp *master) fork() error {
 	return nil
 }
 
+// a slave process started by the master
+type slaveProcess struct {
+	id        int
+	worker    int
+	canary    bool
+	cmd       *exec.Cmd
+	startedAt time.Time
+	upgrade   *upgrade
+	//closed once the program calls State.Ready()
+	ready     chan bool
+	readyOnce sync.Once
+	//closed once the process has exited, err is its wait result
+	done chan bool
+	err  error
+	//set once the master asks the process to stop
+	stopping atomic.Bool
+	//closed once the program has released its sockets
+	released     chan bool
+	releasedOnce sync.Once
+	//closed once the program has written its handover,
+	//or can no longer write it
+	handedOver   chan bool
+	handoverOnce sync.Once
+	handover     []byte
+}
+
+func (s *slaveProcess) exited() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// startSlave starts a process running the program as the given
+// worker, which is always 0 unless Config.Workers is set
+func (mp *master) startSlave(worker int) (*slaveProcess, error) {
+	s := &slaveProcess{worker: worker}
+	if err := mp.startProcess(s, mp.binPath, mp.binHash); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// startProcess starts s running the given binary
+func (mp *master) startProcess(s *slaveProcess, binPath, binHash string) error {
+	mslog.Debug("starting", "bin-path", binPath, "worker", s.worker, "canary", s.canary)
+	cmd := exec.Command(binPath)
+	mp.slaveID++
+	s.id = mp.slaveID
+	s.cmd = cmd
+	s.ready = make(chan bool)
+	s.done = make(chan bool)
+	s.released = make(chan bool)
+	s.handedOver = make(chan bool)
+	//the program this one replaces, if any
+	var prev *slaveProcess
+	if !s.canary {
+		prev = mp.currentWorker(s.worker)
+	}
+	//provide the slave process with some state
+	e := os.Environ()
+	e = append(e, envBinID+"="+binHash)
+	e = append(e, envBinPath+"="+binPath)
+	e = append(e, envSlaveID+"="+strconv.Itoa(s.id))
+	e = append(e, envIsSlave+"=1")
+	e = append(e, envWorker+"="+strconv.Itoa(s.worker))
+	e = append(e, envWorkers+"="+strconv.Itoa(mp.Workers))
+	if s.canary {
+		e = append(e, envCanary+"=1")
+	}
+	e = append(e, mp.supervisorEnv()...)
+	//include socket files
+	mp.reconcileSockets()
+	files := make([]*os.File, len(mp.sockets))
+	infos := make([]fdInfo, len(mp.sockets))
+	for i, ms := range mp.sockets {
+		files[i] = ms.file
+		infos[i] = ms.fdInfo
+	}
+	fds, _ := json.Marshal(infos)
+	e = append(e, envNumFDs+"="+strconv.Itoa(len(files)))
+	e = append(e, envFDs+"="+string(fds))
+	//include registered files, they must stay open until started
+	mp.filesMux.Lock()
+	if names, registered := mp.registeredFiles(); len(names) > 0 {
+		b, _ := json.Marshal(names)
+		e = append(e, envFiles+"="+string(b))
+		files = append(files, registered...)
+	}
+	//open a channel for the slave to talk back to the master
+	conn, childFile, err := channelPair()
+	if err != nil {
+		mslog.Debug("channel unavailable, assuming slave is always ready", "err", err)
+		close(s.ready)
+		close(s.handedOver)
+	} else {
+		e = append(e, envChannelFD+"="+strconv.Itoa(3+len(files)))
+		files = append(files, childFile)
+	}
+	cmd.Env = e
+	//inherit master args/stdfiles
+	cmd.Args = os.Args
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	mp.filesMux.Unlock()
+	if childFile != nil {
+		childFile.Close()
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return fmt.Errorf("Failed to start slave process: %s", err)
+	}
+	s.startedAt = time.Now()
+	mp.emit(SlaveStartedEvent{SlaveID: s.id, PID: cmd.Process.Pid, Hash: binHash})
+	//an upgraded binary is on probation from its first start
+	if !s.canary {
+		s.upgrade = mp.startProbation(s)
+	}
+	if conn != nil {
+		c := newChannel(conn)
+		go mp.readChannel(s, c)
+		go mp.brokerHandover(prev, s, c)
+	}
+	//convert wait into channel
+	go func() {
+		s.err = cmd.Wait()
+		mp.emit(SlaveExitedEvent{
+			SlaveID:  s.id,
+			PID:      cmd.Process.Pid,
+			ExitCode: cmd.ProcessState.ExitCode(),
+			Expected: s.stopping.Load(),
+		})
+		close(s.done)
+	}()
+	return nil
+}
+
+// readChannel is run in a goroutine, it handles
+// messages from a slave process until it exits
+func (mp *master) readChannel(s *slaveProcess, c *channel) {
+	defer c.Close()
+	err := c.receive(func(msg channelMsg) {
+		switch msg.Type {
+		case msgReady:
+			s.readyOnce.Do(func() {
+				mslog.Debug("slave ready", "slave-id", s.id)
+				mp.emit(SlaveReadyEvent{SlaveID: s.id, PID: s.cmd.Process.Pid})
+				close(s.ready)
+			})
+		case msgReleased:
+			s.releasedOnce.Do(func() {
+				mslog.Debug("slave released sockets", "slave-id", s.id)
+				close(s.released)
+			})
+		case msgFile:
+			mp.registerFile(msg.Name, msg.file)
+		case msgRemoveFile:
+			mp.unregisterFile(msg.Name)
+		case msgRollback:
+			go func() {
+				reply := ""
+				n, _ := strconv.Atoi(string(msg.Data))
+				if err := mp.rollbackTo(n); err != nil {
+					reply = err.Error()
+				}
+				c.send(channelMsg{Type: msgRollback, Data: []byte(reply)})
+			}()
+		case msgHandover:
+			s.handoverOnce.Do(func() {
+				mslog.Debug("slave handed over", "slave-id", s.id, "bytes", len(msg.Data))
+				s.handover = msg.Data
+				close(s.handedOver)
+			})
+		default:
+			mslog.Debug("unknown channel message", "slave-id", s.id, "type", msg.Type)
+		}
+	})
+	if err != nil && err != io.EOF {
+		mslog.Debug("channel closed", "slave-id", s.id, "err", err)
+	}
+	//nothing more can be handed over
+	s.handoverOnce.Do(func() {
+		close(s.handedOver)
+	})
+}
+
 func token() string {
 	buff := make([]byte, 8)
 	rand.Read(buff)
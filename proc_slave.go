@@ -1,12 +1,14 @@
 package selfup
 
 import (
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -29,14 +31,31 @@ type State struct {
 	Enabled bool
 	//ID is a SHA-1 hash of the current running binary
 	ID string
+	//Version of the current running binary, see Config.Version
+	Version string
 	//StartedAt records the start time of the program
 	StartedAt time.Time
 	//Listener is the first net.Listener in Listeners
 	Listener net.Listener
 	//Listeners are the set of acquired sockets by the master
 	//process. These are all passed into this program in the
-	//same order they are specified in Config.Addresses.
+	//same order they are specified in Config.Addresses, followed
+	//by Config.NamedAddresses sorted by name.
 	Listeners []net.Listener
+	//ListenersByName are the Listeners by their name in
+	//Config.NamedAddresses, or their entry in Config.Addresses
+	ListenersByName map[string]net.Listener
+	//PacketConn is the first net.PacketConn in PacketConns
+	PacketConn net.PacketConn
+	//PacketConns are the datagram sockets (udp:// and unixgram://
+	//addresses) acquired by the master process, in the same order
+	//as Listeners. They are not included in Listeners. After a
+	//GracefulShutdown, reads return net.ErrClosed and the next
+	//program receives any further datagrams, though writes
+	//continue to work until exit.
+	PacketConns []net.PacketConn
+	//PacketConnsByName are the PacketConns by name, see ListenersByName
+	PacketConnsByName map[string]net.PacketConn
 	//Program's first listening address
 	Address string
 	//Program's listening addresses
@@ -44,19 +63,61 @@ type State struct {
 	//GracefulShutdown will be filled when its time to perform
 	//a graceful shutdown.
 	GracefulShutdown chan bool
+	//Files registered by previous programs with RegisterFile,
+	//by name. They are passed to every following program.
+	Files map[string]*os.File
+	//Worker is the index of this process among Config.Workers,
+	//from 0 to Workers-1
+	Worker  int
+	Workers int
+	//Canary is true when this program is a fetched binary on
+	//trial alongside the current program, see Config.Canary
+	Canary bool
+	//CrashRestarts counts how many times the program has been
+	//restarted by Config.RestartPolicy since the master started
+	CrashRestarts int
+	//LastExitCode is the exit code of the program which
+	//was last restarted by Config.RestartPolicy
+	LastExitCode int
 	//Path of the binary currently being executed
 	BinPath string
+	//connection back to the master process
+	channel *channel
+	//closed once the handover has been received
+	handover     []byte
+	handoverDone chan bool
+	//replies to Rollback
+	rollbacks chan string
+}
+
+// the state of the program, when run by selfup
+var runningState *State
+
+// Ready tells the master process that the program is serving.
+// When Config.ReadyTimeout is set, a restart waits for the new
+// program to be ready before the previous one is shut down.
+func (s *State) Ready() {
+	if s.channel == nil {
+		return
+	}
+	if err := s.channel.send(channelMsg{Type: msgReady}); err != nil {
+		sslog.Warn("failed to notify master of readiness", "err", err)
+	}
 }
 
 //a selfup slave process
 
 type slave struct {
 	*Config
-	id         string
-	listeners  []*selfupListener
-	masterPid  int
-	masterProc *os.Process
-	state      State
+	id          string
+	listeners   []*selfupListener
+	packetConns []*selfupPacketConn
+	//the socket of each entry in state.Listeners
+	listenerSpecs []socketSpec
+	handoverOnce  sync.Once
+	masterPid     int
+	masterProc    *os.Process
+	state         State
 }
 
 func (sp *slave) run() error {
@@ -64,18 +125,36 @@ func (sp *slave) run() error {
 	sslog.Debug("run", "slave-id", sp.id)
 	sp.state.Enabled = true
 	sp.state.ID = os.Getenv(envBinID)
+	sp.state.Version = sp.Config.Version
 	sp.state.StartedAt = time.Now()
 	sp.state.Address = sp.Config.Address
 	sp.state.Addresses = sp.Config.Addresses
 	sp.state.GracefulShutdown = make(chan bool, 1)
 	sp.state.BinPath = os.Getenv(envBinPath)
+	sp.state.Worker, _ = strconv.Atoi(os.Getenv(envWorker))
+	if sp.state.Workers, _ = strconv.Atoi(os.Getenv(envWorkers)); sp.state.Workers <= 0 {
+		sp.state.Workers = 1
+	}
+	sp.state.Canary = os.Getenv(envCanary) == "1"
+	sp.state.CrashRestarts, _ = strconv.Atoi(os.Getenv(envCrashRestarts))
+	sp.state.LastExitCode, _ = strconv.Atoi(os.Getenv(envLastExitCode))
 	if err := sp.watchParent(); err != nil {
 		return err
 	}
 	if err := sp.initFileDescriptors(); err != nil {
 		return err
 	}
+	if err := sp.initTLS(); err != nil {
+		return err
+	}
+	if err := sp.initFiles(); err != nil {
+		return err
+	}
+	if err := sp.initChannel(); err != nil {
+		return err
+	}
 	sp.watchSignal()
+	runningState = &sp.state
 	//run program with state
 	sslog.Debug("start program", "slave-id", sp.id)
 	sp.Config.Program(&sp.state)
@@ -88,21 +167,93 @@ func (sp *slave) initFileDescriptors() error {
 	if err != nil {
 		return fmt.Errorf("invalid %s integer", envNumFDs)
 	}
-	sp.listeners = make([]*selfupListener, numFDs)
-	sp.state.Listeners = make([]net.Listener, numFDs)
-	for i := 0; i < numFDs; i++ {
+	infos, err := sp.fdInfos(numFDs)
+	if err != nil {
+		return err
+	}
+	sp.state.ListenersByName = map[string]net.Listener{}
+	sp.state.PacketConnsByName = map[string]net.PacketConn{}
+	addresses := []string{}
+	for i, info := range infos {
 		f := os.NewFile(uintptr(3+i), "")
-		l, err := net.FileListener(f)
-		if err != nil {
-			return fmt.Errorf("failed to inherit file descriptor: %d", i)
+		if isPacketNetwork(info.Network) {
+			c, err := net.FilePacketConn(f)
+			if err != nil {
+				return fmt.Errorf("failed to inherit file descriptor: %d", i)
+			}
+			u := newOverseerPacketConn(c)
+			sp.packetConns = append(sp.packetConns, u)
+			sp.state.PacketConns = append(sp.state.PacketConns, u)
+			sp.state.PacketConnsByName[info.Name] = u
+		} else {
+			l, err := net.FileListener(f)
+			if err != nil {
+				return fmt.Errorf("failed to inherit file descriptor: %d", i)
+			}
+			u := newOverseerListener(l)
+			sp.listeners = append(sp.listeners, u)
+			sp.listenerSpecs = append(sp.listenerSpecs, info.socketSpec)
+			sp.state.Listeners = append(sp.state.Listeners, u)
+			sp.state.ListenersByName[info.Name] = u
 		}
-		u := newOverseerListener(l)
-		sp.listeners[i] = u
-		sp.state.Listeners[i] = u
+		f.Close()
+		addresses = append(addresses, info.Address)
+	}
+	//the master's sockets may differ from this binary's config
+	sp.state.Addresses = addresses
+	sp.state.Address = ""
+	if len(addresses) > 0 {
+		sp.state.Address = addresses[0]
 	}
 	if len(sp.state.Listeners) > 0 {
 		sp.state.Listener = sp.state.Listeners[0]
 	}
+	if len(sp.state.PacketConns) > 0 {
+		sp.state.PacketConn = sp.state.PacketConns[0]
+	}
+	return nil
+}
+
+// fdInfos describes the inherited descriptors, masters
+// which don't describe them only pass tcp Addresses
+func (sp *slave) fdInfos(numFDs int) ([]fdInfo, error) {
+	infos := []fdInfo{}
+	if s := os.Getenv(envFDs); s != "" {
+		if err := json.Unmarshal([]byte(s), &infos); err != nil || len(infos) != numFDs {
+			return nil, fmt.Errorf("invalid %s", envFDs)
+		}
+		return infos, nil
+	}
+	for i := 0; i < numFDs; i++ {
+		info := fdInfo{Network: "tcp"}
+		if i < len(sp.Config.Addresses) {
+			info.Name = sp.Config.Addresses[i]
+			info.Address = sp.Config.Addresses[i]
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (sp *slave) initChannel() error {
+	fd := os.Getenv(envChannelFD)
+	if fd == "" {
+		return nil //master has no channel
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("invalid %s integer", envChannelFD)
+	}
+	f := os.NewFile(uintptr(n), "")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to inherit channel (%s)", err)
+	}
+	sp.state.channel = newChannel(conn)
+	sp.state.handoverDone = make(chan bool)
+	sp.state.rollbacks = make(chan string, 1)
+	go sp.readChannel()
 	return nil
 }
 
@@ -116,16 +267,19 @@ func (sp *slave) watchSignal() {
 		//master wants to restart,
 		close(sp.state.GracefulShutdown)
 		//release any sockets and notify master
-		if len(sp.listeners) > 0 {
+		if len(sp.listeners) > 0 || len(sp.packetConns) > 0 {
 			//perform graceful shutdown
 			for _, l := range sp.listeners {
 				l.release(sp.Config.TerminateTimeout)
 			}
+			for _, c := range sp.packetConns {
+				c.release()
+			}
 			//signal release of held sockets, allows master to start
 			//a new process before this child has actually exited.
 			//early restarts not supported with restarts disabled.
 			if !sp.NoRestart {
-				sp.masterProc.Signal(SIGUSR1)
+				sp.releaseSockets()
 			}
 			//listeners should be waiting on connections to close...
 		}
@@ -138,6 +292,17 @@ func (sp *slave) watchSignal() {
 	}()
 }
 
+// releaseSockets tells the master this program's sockets
+// have been released, over the channel when there is one
+func (sp *slave) releaseSockets() {
+	if c := sp.state.channel; c != nil {
+		if err := c.send(channelMsg{Type: msgReleased}); err == nil {
+			return
+		}
+	}
+	sp.masterProc.Signal(SIGUSR1)
+}
+
 func (sp *slave) triggerRestart() {
 	if err := sp.masterProc.Signal(sp.Config.RestartSignal); err != nil {
 		os.Exit(1)
@@ -0,0 +1,183 @@
+package selfup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// upgrade is a binary which has been installed but has
+// not yet passed probation, it holds what's needed to undo it
+type upgrade struct {
+	prevHash    string
+	prevVersion string
+	prevSockets []socketSpec
+	hash        string
+	backupPath  string
+	slaveID     int
+}
+
+func (mp *master) isBadHash(digest string) bool {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	return mp.badHashes[digest]
+}
+
+// install replaces the current binary with src, usually the temp binary.
+// When rollbacks are enabled, the last known good binary is backed up
+// first. Source is recorded in the history, such as the fetcher type.
+func (mp *master) install(src, digest, version string, sockets []socketSpec, source string) error {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	//binaries which don't declare their sockets keep the current ones
+	if sockets == nil {
+		sockets = mp.binSockets
+	}
+	if mp.Probation <= 0 {
+		if err := overwrite(mp.binPath, src); err != nil {
+			return err
+		}
+		mp.binHash = digest
+		mp.binVersion = version
+		mp.binSockets = sockets
+		mp.recordHistory(digest, version, sockets, source)
+		return nil
+	}
+	u := &upgrade{hash: digest}
+	created := false
+	if prev := mp.upgrade; prev != nil {
+		//the current binary never passed probation,
+		//so keep the backup of the last good one
+		u.prevHash = prev.prevHash
+		u.prevVersion = prev.prevVersion
+		u.prevSockets = prev.prevSockets
+		u.backupPath = prev.backupPath
+	} else {
+		u.prevHash = mp.binHash
+		u.prevVersion = mp.binVersion
+		u.prevSockets = mp.binSockets
+		u.backupPath = filepath.Join(os.TempDir(), "selfup-"+token()+"-backup"+extension())
+		if err := copyFile(u.backupPath, mp.binPath, mp.binPerms); err != nil {
+			return fmt.Errorf("backup failed (%s)", err)
+		}
+		created = true
+	}
+	if err := overwrite(mp.binPath, src); err != nil {
+		if created {
+			os.Remove(u.backupPath)
+		}
+		return err
+	}
+	mp.upgrade = u
+	mp.binHash = digest
+	mp.binVersion = version
+	mp.binSockets = sockets
+	mp.recordHistory(digest, version, sockets, source)
+	return nil
+}
+
+// startProbation is called after each fork and returns the
+// pending upgrade the new slave is running, if any. The first
+// slave to run an upgrade starts its probation timer.
+func (mp *master) startProbation(s *slaveProcess) *upgrade {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	u := mp.upgrade
+	if u == nil || u.hash != mp.binHash {
+		return nil
+	}
+	if u.slaveID == 0 {
+		u.slaveID = s.id
+		go mp.probation(u, s)
+	}
+	return u
+}
+
+// probation is run in a goroutine, it waits out the probation
+// window and then either commits or rolls back the upgrade
+func (mp *master) probation(u *upgrade, s *slaveProcess) {
+	//with the readiness handshake, probation starts once ready
+	if mp.ReadyTimeout > 0 {
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return
+		}
+	}
+	mslog.Info("upgrade on probation", "bin-hash", u.hash, "probation", mp.Probation)
+	time.Sleep(mp.Probation)
+	if !mp.pending(u) {
+		return
+	}
+	if mp.HealthCheck != nil {
+		if err := mp.HealthCheck(); err != nil {
+			if mp.rollback(u, "health check failed: "+err.Error()) {
+				mslog.Warn("upgraded program failed health check, rolled back", "err", err)
+				mp.triggerRestart()
+			}
+			return
+		}
+	}
+	mp.commit(u)
+}
+
+func (mp *master) pending(u *upgrade) bool {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	return mp.upgrade == u
+}
+
+// commit discards the backup of a successful upgrade
+func (mp *master) commit(u *upgrade) {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	if mp.upgrade != u {
+		return
+	}
+	mp.upgrade = nil
+	os.Remove(u.backupPath)
+	mslog.Info("upgrade passed probation", "bin-hash", u.hash)
+	mp.emit(UpgradeCommittedEvent{Hash: u.hash, Version: mp.binVersion})
+}
+
+// rollback restores the backup of a failed upgrade and
+// remembers its hash so it won't be installed again. Returns
+// true if the previous binary was restored.
+func (mp *master) rollback(u *upgrade, reason string) bool {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	if mp.upgrade != u {
+		return false
+	}
+	mp.upgrade = nil
+	mp.badHashes[u.hash] = true
+	if err := overwrite(mp.binPath, u.backupPath); err != nil {
+		mslog.Error("failed to restore previous binary", "err", err)
+		return false
+	}
+	mp.binHash = u.prevHash
+	mp.binVersion = u.prevVersion
+	mp.binSockets = u.prevSockets
+	mp.recordHistory(u.prevHash, u.prevVersion, u.prevSockets, "rollback")
+	mp.emit(RolledBackEvent{Hash: u.hash, RestoredHash: u.prevHash, Reason: reason})
+	return true
+}
+
+func copyFile(dst, src string, perms os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perms)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
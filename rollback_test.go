@@ -0,0 +1,96 @@
+//go:build linux || darwin || freebsd
+
+package selfup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestStopDuringProbation stops a child test process acting as the
+// master while an upgrade is on probation, the master must exit and
+// keep the upgrade instead of rolling it back and restarting
+func TestStopDuringProbation(t *testing.T) {
+	if dir := os.Getenv("SELFUP_TEST_PROBATION"); dir != "" {
+		probationChild(t, dir)
+		return
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	if err := os.WriteFile(bin, []byte("upgraded"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "backup"), []byte("previous"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestStopDuringProbation$", "-test.v")
+	cmd.Env = append(os.Environ(), "SELFUP_TEST_PROBATION="+dir)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		t.Fatalf("master didn't exit\n%s", out)
+	}
+	if exitCode(err) == 0 {
+		t.Fatalf("master exited with 0, want the stopped program's code\n%s", out)
+	}
+	if strings.Contains(string(out), "FAIL") {
+		t.Fatalf("child failed\n%s", out)
+	}
+	if strings.Contains(string(out), "rolled back") {
+		t.Fatalf("upgrade rolled back\n%s", out)
+	}
+	if b, _ := os.ReadFile(bin); string(b) != "upgraded" {
+		t.Fatalf("binary is %q, want the upgrade kept", b)
+	}
+}
+
+// probationChild runs a master whose slave is a sleep process
+// on probation, and stops it with SIGTERM
+func probationChild(t *testing.T, dir string) {
+	mp := &master{
+		Config: &Config{
+			Probation:        time.Hour,
+			TerminateTimeout: time.Second,
+		},
+		binPath:   filepath.Join(dir, "bin"),
+		binHash:   "upgraded",
+		badHashes: map[string]bool{},
+		events: newEventQueue(func(e Event) {
+			if rb, ok := e.(RolledBackEvent); ok {
+				fmt.Println("rolled back", rb.Hash)
+			}
+		}),
+	}
+	_, mp.stopFetching = context.WithCancel(context.Background())
+	u := &upgrade{
+		prevHash:   "previous",
+		hash:       "upgraded",
+		backupPath: filepath.Join(dir, "backup"),
+		slaveID:    1,
+	}
+	mp.upgrade = u
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := &slaveProcess{id: 1, cmd: cmd, upgrade: u, done: make(chan bool)}
+	go func() {
+		s.err = cmd.Wait()
+		close(s.done)
+	}()
+	mp.slaveCmd = cmd
+	mp.slave = s
+	mp.nextSlave = s
+	mp.handleSignal(syscall.SIGTERM)
+	//exits the process once the program has stopped
+	mp.fork()
+	t.Fatalf("master would start the program again (bad hash %v)", mp.isBadHash("upgraded"))
+}
@@ -10,16 +10,25 @@ import (
 	"time"
 
 	"github.com/rainkfun/selfup/fetcher"
+	"github.com/rainkfun/selfup/verifier"
 )
 
 const (
 	envSlaveID        = "OVERSEER_SLAVE_ID"
 	envIsSlave        = "OVERSEER_IS_SLAVE"
 	envNumFDs         = "OVERSEER_NUM_FDS"
+	envFDs            = "OVERSEER_FDS"
+	envFiles          = "OVERSEER_FILES"
 	envBinID          = "OVERSEER_BIN_ID"
 	envBinPath        = "OVERSEER_BIN_PATH"
 	envBinCheck       = "OVERSEER_BIN_CHECK"
 	envBinCheckLegacy = "GO_UPGRADE_BIN_CHECK"
+	envChannelFD      = "OVERSEER_CHANNEL_FD"
+	envCrashRestarts  = "OVERSEER_CRASH_RESTARTS"
+	envWorker         = "OVERSEER_WORKER"
+	envWorkers        = "OVERSEER_WORKERS"
+	envCanary         = "OVERSEER_CANARY"
+	envLastExitCode   = "OVERSEER_LAST_EXIT_CODE"
 )
 
 // Config defines selfup's run-time configuration
@@ -31,8 +40,34 @@ type Config struct {
 	Program func(state *State)
 	//Program's zero-downtime socket listening address (set this or Addresses)
 	Address string
-	//Program's zero-downtime socket listening addresses (set this or Address)
+	//Program's zero-downtime socket listening addresses (set this or Address).
+	//Addresses are TCP unless prefixed with "udp://", "unix://" or
+	//"unixgram://", for example "unix:///run/myapp.sock".
 	Addresses []string
+	//NamedAddresses are additional listening addresses by name, see
+	//State.ListenersByName. When an upgraded binary declares different
+	//Addresses or NamedAddresses, the master opens the new sockets and
+	//closes the removed ones once the previous program has exited.
+	NamedAddresses map[string]string
+	//TLS enables TLS on listeners, keyed by their entry in Addresses or
+	//name in NamedAddresses. The program receives these listeners
+	//already wrapped with TLS.
+	TLS map[string]TLSConfig
+	//TLSReloadSignal reloads the TLS certificates without a restart,
+	//they're also reloaded when their files change. Defaults to SIGHUP.
+	TLSReloadSignal os.Signal
+	//SocketMode sets the file mode of unix:// and unixgram:// sockets
+	//created for Addresses, defaults to the mode allowed by the umask.
+	SocketMode os.FileMode
+	//SocketOwner and SocketGroup optionally change the owner and group
+	//of unix:// and unixgram:// sockets, as names or numeric IDs.
+	SocketOwner string
+	SocketGroup string
+	//Workers starts this many processes running the program, which all
+	//share the same sockets. A restart replaces the workers one at a time,
+	//so the others keep serving. A worker which exits unexpectedly stops
+	//the others, unless RestartPolicy restarts it. Defaults to 1.
+	Workers int
 	//RestartSignal will manually trigger a graceful restart. Defaults to SIGUSR2.
 	RestartSignal os.Signal
 	//TerminateTimeout controls how long selfup should
@@ -41,19 +76,100 @@ type Config struct {
 	TerminateTimeout time.Duration
 	//MinFetchInterval defines the smallest duration between Fetch()s.
 	//This helps to prevent unwieldy fetch.Interfaces from hogging
-	//too many resources. Defaults to 1 second.
+	//too many resources. Fetchers implementing fetcher.ContextInterface
+	//are fetched every FetchInterval, but no sooner. Defaults to 1 second.
 	MinFetchInterval time.Duration
 	//PreUpgrade runs after a binary has been retrieved, user defined checks
 	//can be run here and returning an error will cancel the upgrade.
 	PreUpgrade func(tempBinaryPath string) error
+	//PostUpgrade runs after a new binary has replaced the current one
+	//and before the program is restarted.
+	PostUpgrade func(binaryPath string)
+	//Probation is the period after an upgrade during which the new
+	//program is still on trial. If the upgraded program exits during
+	//this window, the previous binary is restored and restarted and
+	//the failed binary will not be installed again. Programs stopped
+	//by the master, such as on SIGTERM, aren't rolled back. Defaults to 0,
+	//which disables rollbacks.
+	Probation time.Duration
+	//HealthCheck optionally runs in the master process at the end of
+	//the Probation window, returning an error will roll back the upgrade.
+	HealthCheck func() error
+	//Canary runs each fetched binary alongside the current program, on
+	//the same sockets, for this long before it's installed. A canary
+	//which exits, isn't ready within ReadyTimeout or fails CanaryCheck
+	//is discarded and its hash is never installed. Binaries which
+	//declare different sockets can't run as a canary and are refused.
+	//Defaults to 0, which disables canaries.
+	Canary time.Duration
+	//CanaryCheck optionally runs in the master process at the end of the
+	//Canary period with the pid of the canary, returning an error will
+	//discard the new binary.
+	CanaryCheck func(pid int) error
+	//ReadyTimeout enables the readiness handshake. When set, a restart
+	//starts the new program alongside the current one and waits up to
+	//this long for it to call State.Ready() before the current program
+	//is asked to shut down. A new program which isn't ready in time is
+	//killed and the current program keeps running. Defaults to 0, which
+	//disables the handshake.
+	ReadyTimeout time.Duration
+	//RestartPolicy makes the master restart the program when it exits
+	//without being asked to, instead of exiting with the program's exit
+	//code. One of RestartNever (the default), RestartOnFailure or
+	//RestartAlways. Signals which stop the program, such as SIGTERM,
+	//still stop the master.
+	RestartPolicy RestartPolicy
+	//RestartBackoff is the delay before restarting the program, doubled
+	//for each restart within RestartWindow up to RestartMaxBackoff.
+	//Defaults to 1 second, with a maximum of 1 minute.
+	RestartBackoff    time.Duration
+	RestartMaxBackoff time.Duration
+	//MaxRestarts limits the restarts within RestartWindow. When a program
+	//exits again after MaxRestarts, it's considered to be crash looping
+	//and the master exits with its exit code. Defaults to 5 restarts
+	//within 1 minute.
+	MaxRestarts   int
+	RestartWindow time.Duration
 	//NoRestart disables all restarts, this option essentially converts
 	//the RestartSignal into a "ShutdownSignal".
 	NoRestart bool
 	//NoRestartAfterFetch disables automatic restarts after each upgrade.
 	//Though manual restarts using the RestartSignal can still be performed.
 	NoRestartAfterFetch bool
+	//Version of this binary, used to refuse downgrades. Defaults
+	//to the module version stamped into the binary by the go tool.
+	//Fetched binaries report theirs during the sanity check.
+	Version string
+	//AllowDowngrade permits installing fetched binaries whose version
+	//is older than the running one. Only applies when both are known.
+	AllowDowngrade bool
+	//History keeps this many previous binaries, with their hash, version,
+	//install time and source, in a store directory next to the executable.
+	//See Rollback. Defaults to 0, which keeps no history.
+	History int
+	//HistoryDir overrides the store directory, which defaults to the
+	//path of the executable with a ".history" suffix.
+	HistoryDir string
+	//ControlSocket is an optional unix socket path on which the master
+	//process serves operator commands (status, metrics, restart, check-now,
+	//pause-updates, resume-updates, history and rollback). See package control.
+	ControlSocket string
+	//MetricsAddress is an optional local address, such as "127.0.0.1:9100",
+	//on which the master process serves Prometheus metrics at /metrics.
+	//Metrics are also available with the control socket's metrics command.
+	MetricsAddress string
 	//Fetcher will be used to fetch binaries.
 	Fetcher fetcher.Interface
+	//Verifier optionally checks each fetched binary against the
+	//detached signature provided by the Fetcher, before PreUpgrade.
+	//Binaries without a valid signature are never installed.
+	Verifier verifier.Interface
+	//OnEvent optionally receives lifecycle events of the master process,
+	//such as upgrades, rollbacks and restarts (see Event). It is called
+	//in order from a separate goroutine and any pending events are
+	//delivered before the master process exits. Up to 64 events are
+	//queued, further events are dropped until OnEvent catches up.
+	OnEvent func(Event)
 }
 
 func validate(c *Config) error {
@@ -69,9 +185,58 @@ func validate(c *Config) error {
 	} else if len(c.Addresses) > 0 {
 		c.Address = c.Addresses[0]
 	}
+	names := map[string]string{}
+	for _, spec := range c.socketSpecs() {
+		if spec.Name == "" || spec.Address == "" {
+			return errors.New("selfup.Config.NamedAddresses cant contain empty names or addresses")
+		}
+		if _, ok := names[spec.Name]; ok {
+			return fmt.Errorf("selfup.Config address name %s is not unique", spec.Name)
+		}
+		names[spec.Name] = spec.Address
+	}
+	for key := range c.TLS {
+		addr, ok := names[key]
+		if !ok {
+			return fmt.Errorf("selfup.Config.TLS %s is not an address or name", key)
+		}
+		if network, _, err := parseAddress(addr); err != nil || isPacketNetwork(network) {
+			return fmt.Errorf("selfup.Config.TLS %s must be a stream address", key)
+		}
+	}
+	if c.TLSReloadSignal == nil {
+		c.TLSReloadSignal = SIGHUP
+	}
+	if c.HealthCheck != nil && c.Probation <= 0 {
+		return errors.New("selfup.Config.HealthCheck requires Probation")
+	}
+	if c.CanaryCheck != nil && c.Canary <= 0 {
+		return errors.New("selfup.Config.CanaryCheck requires Canary")
+	}
+	if c.Version == "" {
+		c.Version = buildVersion()
+	}
 	if c.RestartSignal == nil {
 		c.RestartSignal = SIGUSR2
 	}
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if err := c.RestartPolicy.validate(); err != nil {
+		return err
+	}
+	if c.RestartBackoff <= 0 {
+		c.RestartBackoff = 1 * time.Second
+	}
+	if c.RestartMaxBackoff <= 0 {
+		c.RestartMaxBackoff = 1 * time.Minute
+	}
+	if c.MaxRestarts <= 0 {
+		c.MaxRestarts = 5
+	}
+	if c.RestartWindow <= 0 {
+		c.RestartWindow = 1 * time.Minute
+	}
 	if c.TerminateTimeout <= 0 {
 		c.TerminateTimeout = 30 * time.Second
 	}
@@ -105,10 +270,14 @@ func Run(c Config) {
 }
 
 // sanityCheck returns true if a check was performed
-func sanityCheck() bool {
+func sanityCheck(c *Config) bool {
 	//sanity check
 	if token := os.Getenv(envBinCheck); token != "" {
 		fmt.Fprint(os.Stdout, token)
+		if c != nil {
+			printSanitySockets(c)
+			printSanityVersion(c)
+		}
 		return true
 	}
 	//legacy sanity check using old env var
@@ -126,7 +295,7 @@ func sanityCheck() bool {
 // on selfup.Run() though it can be manually run prior whenever
 // necessary.
 func SanityCheck() {
-	if sanityCheck() {
+	if sanityCheck(nil) {
 		os.Exit(0)
 	}
 }
@@ -145,7 +314,7 @@ func runErr(c *Config) error {
 	if err := validate(c); err != nil {
 		return err
 	}
-	if sanityCheck() {
+	if sanityCheck(c) {
 		return nil
 	}
 	//run either in master or slave mode
@@ -0,0 +1,143 @@
+package selfup
+
+//the master can supervise the program, restarting it
+//with a backoff when it exits without being asked to
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RestartPolicy decides whether the master restarts a program
+// which exits without being asked to, see Config.RestartPolicy
+type RestartPolicy string
+
+const (
+	//RestartNever proxies the exit code of the program
+	//out of the master process, this is the default
+	RestartNever RestartPolicy = "never"
+	//RestartOnFailure restarts the program when it exits
+	//with a non-zero code or is killed by a signal
+	RestartOnFailure RestartPolicy = "on-failure"
+	//RestartAlways restarts the program whenever it exits
+	RestartAlways RestartPolicy = "always"
+)
+
+func (p RestartPolicy) validate() error {
+	switch p {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+		return nil
+	}
+	return fmt.Errorf("selfup.Config.RestartPolicy %q is not supported", string(p))
+}
+
+// restarts reports whether a program which exited with code is restarted
+func (p RestartPolicy) restarts(code int) bool {
+	switch p {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return code != 0
+	}
+	return false
+}
+
+// supervisor tracks the restarts made by the RestartPolicy
+type supervisor struct {
+	//recent restarts within the RestartWindow
+	recent []time.Time
+	//total restarts and the exit code which caused the last one
+	restarts     int
+	lastExitCode int
+	//interrupts the wait before a restart
+	stop chan os.Signal
+}
+
+// restartCrashed applies the RestartPolicy to a program which exited
+// unexpectedly. It waits out the backoff and returns true when the
+// program should be started again, false when the master should exit.
+func (mp *master) restartCrashed(s *slaveProcess, code int) bool {
+	backoff, ok := mp.crashBackoff(s, code)
+	if !ok {
+		return false
+	}
+	//while waiting there's no program to proxy signals to
+	mp.backingOff.Store(true)
+	defer mp.backingOff.Store(false)
+	mp.restartMux.Lock()
+	mp.slaveCmd = nil
+	mp.restartMux.Unlock()
+	select {
+	case <-time.After(backoff):
+		return true
+	case sig := <-mp.supervisor.stop:
+		mslog.Debug("stopped while waiting to restart", "signal", sig)
+		return false
+	}
+}
+
+// crashBackoff records a restart by the RestartPolicy, returning how
+// long to wait before it. ok is false if the program isn't restarted.
+func (mp *master) crashBackoff(s *slaveProcess, code int) (backoff time.Duration, ok bool) {
+	if !mp.Config.RestartPolicy.restarts(code) {
+		return 0, false
+	}
+	mp.statusMux.Lock()
+	sv := &mp.supervisor
+	now := time.Now()
+	recent := sv.recent[:0]
+	for _, t := range sv.recent {
+		if now.Sub(t) < mp.Config.RestartWindow {
+			recent = append(recent, t)
+		}
+	}
+	sv.recent = recent
+	n := len(sv.recent)
+	if n < mp.Config.MaxRestarts {
+		sv.recent = append(sv.recent, now)
+		sv.restarts++
+		sv.lastExitCode = code
+	}
+	mp.statusMux.Unlock()
+	if n >= mp.Config.MaxRestarts {
+		mslog.Error("program is crash looping, giving up", "exit-code", code,
+			"restarts", n, "window", mp.Config.RestartWindow)
+		mp.emit(CrashLoopEvent{ExitCode: code, Restarts: n, Window: mp.Config.RestartWindow})
+		return 0, false
+	}
+	backoff = mp.Config.RestartBackoff << n
+	if backoff > mp.Config.RestartMaxBackoff || backoff <= 0 {
+		backoff = mp.Config.RestartMaxBackoff
+	}
+	mslog.Warn("program exited unexpectedly, restarting", "slave-id", s.id, "exit-code", code, "backoff", backoff)
+	mp.emit(CrashRestartEvent{SlaveID: s.id, PID: s.cmd.Process.Pid, ExitCode: code, Backoff: backoff})
+	mp.notify(fmt.Sprintf("STATUS=exited with code %d, restarting in %s", code, backoff))
+	return backoff, true
+}
+
+// exitCode of a slave process from its wait result
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// supervisorEnv passes the restart counts to the program
+func (mp *master) supervisorEnv() []string {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	return []string{
+		envCrashRestarts + "=" + strconv.Itoa(mp.supervisor.restarts),
+		envLastExitCode + "=" + strconv.Itoa(mp.supervisor.lastExitCode),
+	}
+}
@@ -8,8 +8,12 @@ package selfup
 //in some other way on other OSs... TODO!
 
 import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"syscall"
 )
 
@@ -20,25 +24,160 @@ var (
 	SIGUSR1   = syscall.SIGUSR1
 	SIGUSR2   = syscall.SIGUSR2
 	SIGTERM   = syscall.SIGTERM
+	SIGHUP    = syscall.SIGHUP
 )
 
+// move atomically replaces dst with src. src is staged next to dst,
+// renamed there within a filesystem and copied otherwise, and takes
+// the mode, owner and extended attributes of dst, or of src when dst
+// doesn't exist. The staged file is synced and renamed over dst, and
+// the directory is synced afterwards.
 func move(dst, src string) error {
-	if err := os.Rename(src, dst); err == nil {
-		return nil
+	//keep the metadata of the binary being replaced
+	meta := dst
+	info, err := os.Stat(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		meta = src
+		info, err = os.Stat(src)
 	}
-	//HACK: we're shelling out to mv because linux
-	//throws errors when crossing device boundaries.
-	//TODO see sys_posix_mv.go
-	if err := exec.Command("mv", src, dst).Run(); err != nil {
+	if err != nil {
+		return &MoveError{Op: "stat", Src: src, Dst: dst, Err: err}
+	}
+	staged := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".selfup-"+token())
+	copied := false
+	if err := os.Rename(src, staged); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return &MoveError{Op: "stage", Src: src, Dst: dst, Err: linkErr(err)}
+		}
+		//crossing device boundaries
+		if err := stageCopy(staged, src, info.Mode().Perm()); err != nil {
+			return &MoveError{Op: "copy", Src: src, Dst: dst, Err: err}
+		}
+		copied = true
+	}
+	if meta == src && !copied {
+		//the staged file is src
+		meta = staged
+	}
+	//unstage leaves src as it was
+	unstage := func() {
+		if copied {
+			os.Remove(staged)
+		} else {
+			os.Rename(staged, src)
+		}
+	}
+	if op, err := stageMeta(staged, meta, info); err != nil {
+		unstage()
+		return &MoveError{Op: op, Src: src, Dst: dst, Err: err}
+	}
+	if err := os.Rename(staged, dst); err != nil {
+		unstage()
+		return &MoveError{Op: "rename", Src: src, Dst: dst, Err: linkErr(err)}
+	}
+	if copied {
+		os.Remove(src)
+	}
+	//best effort, the move has already happened
+	syncFile(filepath.Dir(dst))
+	return nil
+}
+
+// stageCopy copies src to the staged file
+func stageCopy(staged, src string, perms os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(staged, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perms)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(staged)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(staged)
 		return err
 	}
+	return nil
+}
 
-	// Run sync to 'commit' the mv by clearing caches
-	return syncCmd().Run()
+// stageMeta gives the staged file the mode, owner and extended
+// attributes of meta, whose info is given, and syncs it. Returns
+// the step which failed. The file is opened read only, as it
+// may be the running executable which can't be opened for writing.
+func stageMeta(staged, meta string, info os.FileInfo) (string, error) {
+	out, err := os.Open(staged)
+	if err != nil {
+		return "stage", err
+	}
+	op, err := func() (string, error) {
+		//the umask may have masked the mode
+		if err := out.Chmod(info.Mode()); err != nil {
+			return "chmod", err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if int(st.Uid) != os.Geteuid() || int(st.Gid) != os.Getegid() {
+				if err := out.Chown(int(st.Uid), int(st.Gid)); err != nil {
+					return "chown", err
+				}
+			}
+		}
+		if err := copyXattrs(out, meta); err != nil {
+			return "xattr", err
+		}
+		return "sync", out.Sync()
+	}()
+	if err != nil {
+		out.Close()
+		return op, err
+	}
+	return "close", out.Close()
 }
 
-func syncCmd() *exec.Cmd {
-	return exec.Command("sync")
+// linkErr drops the paths of a rename error, the MoveError has them
+func linkErr(err error) error {
+	if le, ok := err.(*os.LinkError); ok {
+		return le.Err
+	}
+	return err
+}
+
+// syncFile flushes a file or directory to disk
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// channelPair creates a connected pair of unix sockets, the
+// connection is kept by the master and the file is handed to a slave
+func channelPair() (net.Conn, *os.File, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	f := os.NewFile(uintptr(fds[0]), "selfup-channel")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return conn, os.NewFile(uintptr(fds[1]), "selfup-channel"), nil
 }
 
 func chmod(f *os.File, perms os.FileMode) error {
@@ -47,3 +186,47 @@ func chmod(f *os.File, perms os.FileMode) error {
 func chown(f *os.File, uid, gid int) error {
 	return f.Chown(uid, gid)
 }
+
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
+
+// writeWithFile writes b with f's descriptor attached (SCM_RIGHTS)
+func writeWithFile(conn net.Conn, b []byte, f *os.File) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("Not supported")
+	}
+	_, _, err := uc.WriteMsgUnix(b, syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// readWithFiles reads into p, returning any descriptors attached
+func readWithFiles(conn net.Conn, p []byte) (int, []*os.File, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		n, err := conn.Read(p)
+		return n, nil, err
+	}
+	oob := make([]byte, syscall.CmsgSpace(4*maxChannelFiles))
+	n, oobn, _, _, err := uc.ReadMsgUnix(p, oob)
+	if oobn == 0 {
+		return n, nil, err
+	}
+	msgs, perr := syscall.ParseSocketControlMessage(oob[:oobn])
+	if perr != nil {
+		return n, nil, err
+	}
+	files := []*os.File{}
+	for _, msg := range msgs {
+		fds, perr := syscall.ParseUnixRights(&msg)
+		if perr != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "selfup-file"))
+		}
+	}
+	return n, files, err
+}
@@ -5,6 +5,7 @@ package selfup
 
 import (
 	"errors"
+	"net"
 	"os"
 )
 
@@ -15,12 +16,17 @@ var (
 	SIGUSR1   = os.Interrupt
 	SIGUSR2   = os.Interrupt
 	SIGTERM   = os.Kill
+	SIGHUP    = os.Interrupt
 )
 
 func move(dst, src string) error {
 	return errors.New("Not supported")
 }
 
+func channelPair() (net.Conn, *os.File, error) {
+	return nil, nil, errors.New("Not supported")
+}
+
 func chmod(f *os.File, perms os.FileMode) error {
 	return errors.New("Not supported")
 }
@@ -28,3 +34,14 @@ func chmod(f *os.File, perms os.FileMode) error {
 func chown(f *os.File, uid, gid int) error {
 	return errors.New("Not supported")
 }
+
+func closeOnExec(fd int) {}
+
+func writeWithFile(conn net.Conn, b []byte, f *os.File) error {
+	return errors.New("Not supported")
+}
+
+func readWithFiles(conn net.Conn, p []byte) (int, []*os.File, error) {
+	n, err := conn.Read(p)
+	return n, nil, err
+}
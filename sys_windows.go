@@ -5,7 +5,9 @@ package selfup
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -20,6 +22,7 @@ var (
 	SIGUSR1   = syscall.SIGTERM
 	SIGUSR2   = syscall.SIGTERM
 	SIGTERM   = syscall.SIGTERM
+	SIGHUP    = syscall.SIGHUP
 )
 
 func move(dst, src string) error {
@@ -40,6 +43,10 @@ func move(dst, src string) error {
 	return nil
 }
 
+func channelPair() (net.Conn, *os.File, error) {
+	return nil, nil, errors.New("Not supported")
+}
+
 func chmod(f *os.File, perms os.FileMode) error {
 	if err := f.Chmod(perms); err != nil && !strings.Contains(err.Error(), "not supported") {
 		return err
@@ -67,3 +74,14 @@ var replShellMeta = strings.NewReplacer(
 	`&`, `^&`,
 	`|`, `^|`,
 )
+
+func closeOnExec(fd int) {}
+
+func writeWithFile(conn net.Conn, b []byte, f *os.File) error {
+	return errors.New("Not supported")
+}
+
+func readWithFiles(conn net.Conn, p []byte) (int, []*os.File, error) {
+	n, err := conn.Read(p)
+	return n, nil, err
+}
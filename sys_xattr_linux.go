@@ -0,0 +1,59 @@
+package selfup
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// copyXattrs copies the extended attributes of src, such as
+// security labels and file capabilities, to the staged file
+func copyXattrs(dst *os.File, src string) error {
+	size, err := syscall.Listxattr(src, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(src, names); err != nil {
+		return err
+	}
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		attr := string(name)
+		n, err := syscall.Getxattr(src, attr, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(src, attr, value); err != nil {
+			return err
+		}
+		//labels the staged file already has may not be settable
+		if bytes.Equal(getxattr(dst.Name(), attr), value[:n]) {
+			continue
+		}
+		if err := syscall.Setxattr(dst.Name(), attr, value[:n], 0); err != nil && !errors.Is(err, syscall.ENOTSUP) {
+			return err
+		}
+	}
+	return nil
+}
+
+// getxattr returns the value of an extended attribute, nil if unset
+func getxattr(path, attr string) []byte {
+	n, err := syscall.Getxattr(path, attr, nil)
+	if err != nil {
+		return nil
+	}
+	value := make([]byte, n)
+	if n, err = syscall.Getxattr(path, attr, value); err != nil {
+		return nil
+	}
+	return value[:n]
+}
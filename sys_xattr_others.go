@@ -0,0 +1,12 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package selfup
+
+import "os"
+
+// copyXattrs is not implemented, extended
+// attributes are only copied on linux
+func copyXattrs(dst *os.File, src string) error {
+	return nil
+}
@@ -0,0 +1,186 @@
+package selfup
+
+//systemd integration, the master process adopts sockets passed
+//by socket activation and reports its state with sd_notify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//socket activation starts at fd 3 (SD_LISTEN_FDS_START)
+	listenFDsStart = 3
+)
+
+// activatedFile is a socket passed by systemd socket activation
+type activatedFile struct {
+	name string
+	file *os.File
+}
+
+// activatedFiles returns the sockets passed to this process by
+// systemd and clears the environment so slaves don't inherit them
+func activatedFiles() []*activatedFile {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make([]*activatedFile, n)
+	for i := range files {
+		fd := listenFDsStart + i
+		closeOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files[i] = &activatedFile{name: name, file: os.NewFile(uintptr(fd), name)}
+	}
+	return files
+}
+
+// adoptFile returns the activated socket matching the
+// name or address, if any, removing it from the list
+func adoptFile(files []*activatedFile, spec socketSpec) (network string, f *os.File) {
+	network, address, err := parseAddress(spec.Address)
+	if err != nil {
+		return "", nil
+	}
+	for i, af := range files {
+		if af == nil {
+			continue
+		}
+		var local net.Addr
+		if isPacketNetwork(network) {
+			c, err := net.FilePacketConn(af.file)
+			if err != nil {
+				continue
+			}
+			local = c.LocalAddr()
+			c.Close()
+		} else {
+			l, err := net.FileListener(af.file)
+			if err != nil {
+				continue
+			}
+			local = l.Addr()
+			l.Close()
+		}
+		if af.name == spec.Name || matchAddr(network, address, local) {
+			mslog.Debug("adopted activated socket", "name", af.name, "address", spec.Address)
+			files[i] = nil
+			return network, af.file
+		}
+	}
+	return "", nil
+}
+
+// matchAddr checks a configured address against the
+// local address of a socket, an empty or unspecified
+// host matches sockets listening on all interfaces
+func matchAddr(network, address string, local net.Addr) bool {
+	switch l := local.(type) {
+	case *net.UnixAddr:
+		return (network == "unix" || network == "unixgram") && l.Name == address
+	case *net.TCPAddr:
+		a, err := net.ResolveTCPAddr(network, address)
+		return err == nil && !isPacketNetwork(network) && a.Port == l.Port && matchIP(a.IP, l.IP)
+	case *net.UDPAddr:
+		a, err := net.ResolveUDPAddr(network, address)
+		return err == nil && isPacketNetwork(network) && a.Port == l.Port && matchIP(a.IP, l.IP)
+	}
+	return false
+}
+
+func matchIP(want, have net.IP) bool {
+	if want == nil || want.IsUnspecified() {
+		return have == nil || have.IsUnspecified()
+	}
+	return want.Equal(have)
+}
+
+// notifier speaks the sd_notify protocol to the service manager
+type notifier struct {
+	conn net.Conn
+}
+
+// newNotifier connects to $NOTIFY_SOCKET, returns
+// nil when the master isn't run by systemd
+func newNotifier() *notifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	os.Unsetenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	//abstract namespace
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		mslog.Warn("failed to connect to notify socket", "err", err)
+		return nil
+	}
+	return &notifier{conn: conn}
+}
+
+func (mp *master) notify(state ...string) {
+	if mp.notifier == nil {
+		return
+	}
+	if _, err := mp.notifier.conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		mslog.Debug("sd_notify failed", "err", err)
+	}
+}
+
+// notifyReady tells systemd the program is serving
+func (mp *master) notifyReady(s *slaveProcess) {
+	mp.notify("READY=1", "MAINPID="+strconv.Itoa(os.Getpid()),
+		fmt.Sprintf("STATUS=serving pid %d, binary %s", s.cmd.Process.Pid, mp.binDescription()))
+}
+
+func (mp *master) binDescription() string {
+	mp.upgradeMux.Lock()
+	defer mp.upgradeMux.Unlock()
+	if mp.binVersion != "" {
+		return mp.binVersion
+	}
+	return mp.binHash
+}
+
+// watchdog pings systemd while a slave process is running,
+// when the service has WatchdogSec= set
+func (mp *master) watchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	if mp.notifier == nil || err != nil || usec <= 0 {
+		return
+	}
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	mslog.Debug("watchdog enabled", "interval", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if s := mp.currentSlave(); s != nil && !s.exited() {
+				mp.notify("WATCHDOG=1")
+			}
+		}
+	}()
+}
@@ -0,0 +1,200 @@
+//go:build linux
+
+package selfup
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// notifySocket listens on a fake $NOTIFY_SOCKET
+func notifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// expectNotify reads the next datagram, which must contain each state
+func expectNotify(t *testing.T, conn *net.UnixConn, states ...string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 4096)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("no datagram, want %q (%s)", states, err)
+	}
+	lines := strings.Split(string(b[:n]), "\n")
+	for _, s := range states {
+		if !slices.Contains(lines, s) {
+			t.Fatalf("datagram %q, want %q", lines, s)
+		}
+	}
+}
+
+// notifyMaster returns a master notifying the fake
+// socket, with a sleep process standing in for the slave
+func notifyMaster(t *testing.T) (*master, *net.UnixConn) {
+	conn := notifySocket(t)
+	mp := &master{
+		Config: &Config{
+			RestartSignal:    SIGUSR2,
+			TerminateTimeout: 10 * time.Millisecond,
+		},
+		binHash:  "abc",
+		notifier: newNotifier(),
+	}
+	if mp.notifier == nil {
+		t.Fatal("notifier not connected")
+	}
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		t.Fatal("NOTIFY_SOCKET not cleared")
+	}
+	_, mp.stopFetching = context.WithCancel(context.Background())
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := &slaveProcess{id: 1, cmd: cmd, done: make(chan bool)}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		close(s.done)
+	})
+	mp.slaveCmd = cmd
+	mp.slave = s
+	return mp, conn
+}
+
+func TestNotifyReady(t *testing.T) {
+	mp, conn := notifyMaster(t)
+	mp.notifyReady(mp.slave)
+	expectNotify(t, conn,
+		"READY=1",
+		"MAINPID="+strconv.Itoa(os.Getpid()),
+		"STATUS=serving pid "+strconv.Itoa(mp.slaveCmd.Process.Pid)+", binary abc")
+}
+
+func TestNotifyReloading(t *testing.T) {
+	mp, conn := notifyMaster(t)
+	mp.triggerRestart()
+	expectNotify(t, conn, "RELOADING=1", "STATUS=restarting")
+}
+
+func TestNotifyStopping(t *testing.T) {
+	mp, conn := notifyMaster(t)
+	mp.handleSignal(syscall.SIGTERM)
+	expectNotify(t, conn, "STOPPING=1")
+	if !mp.slave.stopping.Load() {
+		t.Fatal("slave not stopping")
+	}
+}
+
+func TestNotifyWatchdog(t *testing.T) {
+	mp, conn := notifyMaster(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	mp.watchdog()
+	expectNotify(t, conn, "WATCHDOG=1")
+	expectNotify(t, conn, "WATCHDOG=1")
+}
+
+func TestNotifyDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	mp := &master{notifier: newNotifier()}
+	if mp.notifier != nil {
+		t.Fatal("notifier without NOTIFY_SOCKET")
+	}
+	//no-op
+	mp.notify("READY=1")
+}
+
+// TestActivatedSockets passes listeners to a child test process the
+// way systemd socket activation does, which adopts them as its sockets
+func TestActivatedSockets(t *testing.T) {
+	if addr := os.Getenv("SELFUP_TEST_ACTIVATED"); addr != "" {
+		activatedChild(t, addr, os.Getenv("SELFUP_TEST_ACTIVATED_ADMIN"))
+		return
+	}
+	files := []*os.File{}
+	addrs := []string{}
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivatedSockets$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		"SELFUP_TEST_ACTIVATED="+addrs[0],
+		"SELFUP_TEST_ACTIVATED_ADMIN="+addrs[1],
+		"LISTEN_FDS=3",
+		"LISTEN_FDNAMES=:admin:unused",
+	)
+	cmd.ExtraFiles = files
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child failed (%s)\n%s", err, out)
+	}
+}
+
+// activatedChild adopts the first socket by its address and the
+// second by its name, the third matches no address and is closed
+func activatedChild(t *testing.T, addr, adminAddr string) {
+	//the pid is only known once the child has started
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	mp := &master{Config: &Config{
+		Addresses: []string{addr},
+		//another port, so only the name matches
+		NamedAddresses: map[string]string{"admin": "127.0.0.1:1"},
+	}}
+	//unadopted sockets would fail to listen on the same addresses
+	if err := mp.retreiveFileDescriptors(); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if v, ok := os.LookupEnv(env); ok {
+			t.Fatalf("%s=%s not cleared", env, v)
+		}
+	}
+	if len(mp.sockets) != 2 {
+		t.Fatalf("%d sockets, want 2", len(mp.sockets))
+	}
+	for i, want := range []string{addr, adminAddr} {
+		ms := mp.sockets[i]
+		l, err := net.FileListener(ms.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := l.Addr().String(); got != want {
+			t.Fatalf("socket %s listens on %s, want %s", ms.Name, got, want)
+		}
+		l.Close()
+		if ms.Network != "tcp" {
+			t.Fatalf("socket %s network %s, want tcp", ms.Name, ms.Network)
+		}
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(listenFDsStart+2), syscall.F_GETFD, 0); errno != syscall.EBADF {
+		t.Fatalf("unused socket not closed (%v)", errno)
+	}
+}
@@ -0,0 +1,192 @@
+package selfup
+
+//tls listeners are wrapped in the slave process, their
+//certificates are reloaded without restarting the program
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+)
+
+// how often certificate files are checked for changes
+const tlsPollInterval = 5 * time.Second
+
+// TLSConfig enables TLS on a listener, see Config.TLS
+type TLSConfig struct {
+	//CertFile and KeyFile are the PEM encoded certificate
+	//chain and private key, both are required
+	CertFile string
+	KeyFile  string
+	//ClientCAFile optionally requires clients to present a
+	//certificate signed by one of the PEM encoded CAs in this file
+	ClientCAFile string
+	//Config is an optional base configuration, its certificates
+	//and client CAs are replaced using the files above
+	Config *tls.Config
+}
+
+func (c TLSConfig) files() []string {
+	files := []string{c.CertFile, c.KeyFile}
+	if c.ClientCAFile != "" {
+		files = append(files, c.ClientCAFile)
+	}
+	return files
+}
+
+// load reads the certificate files into a tls.Config
+func (c TLSConfig) load() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("CertFile and KeyFile required")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{}
+	if c.Config != nil {
+		conf = c.Config.Clone()
+	}
+	conf.Certificates = []tls.Certificate{cert}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.ClientCAFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// tlsReloader serves the latest certificates of an address
+type tlsReloader struct {
+	address  string
+	conf     TLSConfig
+	current  atomic.Pointer[tls.Config]
+	modTimes []time.Time
+}
+
+func newTLSReloader(address string, conf TLSConfig) (*tlsReloader, error) {
+	r := &tlsReloader{address: address, conf: conf}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *tlsReloader) reload() error {
+	modTimes := r.stat()
+	conf, err := r.conf.load()
+	if err != nil {
+		return err
+	}
+	r.current.Store(conf)
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *tlsReloader) stat() []time.Time {
+	files := r.conf.files()
+	modTimes := make([]time.Time, len(files))
+	for i, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (r *tlsReloader) changed() bool {
+	for i, t := range r.stat() {
+		if !t.Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// listener wraps l, each handshake uses the latest certificates
+func (r *tlsReloader) listener(l net.Listener) net.Listener {
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load(), nil
+		},
+	})
+}
+
+// initTLS wraps the listeners of addresses with a TLSConfig
+func (sp *slave) initTLS() error {
+	if len(sp.Config.TLS) == 0 {
+		return nil
+	}
+	reloaders := []*tlsReloader{}
+	for i, spec := range sp.listenerSpecs {
+		conf, ok := sp.Config.TLS[spec.Name]
+		if !ok {
+			if conf, ok = sp.Config.TLS[spec.Address]; !ok {
+				continue
+			}
+		}
+		r, err := newTLSReloader(spec.Address, conf)
+		if err != nil {
+			return fmt.Errorf("TLS for %s (%s)", spec.Name, err)
+		}
+		l := r.listener(sp.state.Listeners[i])
+		sp.state.Listeners[i] = l
+		sp.state.ListenersByName[spec.Name] = l
+		reloaders = append(reloaders, r)
+	}
+	if len(sp.state.Listeners) > 0 {
+		sp.state.Listener = sp.state.Listeners[0]
+	}
+	go sp.watchTLS(reloaders)
+	return nil
+}
+
+// watchTLS reloads certificates when their files change
+// or when the TLSReloadSignal is received
+func (sp *slave) watchTLS(reloaders []*tlsReloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sp.Config.TLSReloadSignal)
+	ticker := time.NewTicker(tlsPollInterval)
+	for {
+		force := false
+		select {
+		case <-signals:
+			force = true
+		case <-ticker.C:
+		}
+		for _, r := range reloaders {
+			if !force && !r.changed() {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				sslog.Warn("failed to reload TLS certificates, keeping previous", "address", r.address, "err", err)
+				continue
+			}
+			sslog.Info("reloaded TLS certificates", "address", r.address)
+		}
+	}
+}
+
+// checkTLS ensures each TLSConfig can be loaded
+// before any program is started
+func checkTLS(c *Config) error {
+	for addr, conf := range c.TLS {
+		if _, err := conf.load(); err != nil {
+			return fmt.Errorf("TLS for %s (%s)", addr, err)
+		}
+	}
+	return nil
+}
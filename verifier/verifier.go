@@ -0,0 +1,25 @@
+// Package verifier checks fetched binaries against
+// their detached signatures before they are installed.
+package verifier
+
+// Interface defines the required verifier functions
+type Interface interface {
+	//Verify should return an error unless signature
+	//is a valid signature of the binary at binPath.
+	//binPath is a temporary copy of the fetched binary
+	//which has not yet been run.
+	Verify(binPath string, signature []byte) error
+}
+
+// Func converts a verify function into the verifier interface
+func Func(fn func(binPath string, signature []byte) error) Interface {
+	return &verifier{fn}
+}
+
+type verifier struct {
+	fn func(binPath string, signature []byte) error
+}
+
+func (v verifier) Verify(binPath string, signature []byte) error {
+	return v.fn(binPath, signature)
+}
@@ -0,0 +1,98 @@
+package verifier
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Ed25519 verifies binaries signed by Sign. Signatures are
+// Ed25519ph over the SHA-512 digest of the binary, so they
+// can be checked without loading the binary into memory.
+type Ed25519 struct {
+	//PublicKey is the base64 encoded public key as returned
+	//from GenerateKey. It can be embedded into the binary with
+	//-ldflags "-X main.publicKey=..."
+	PublicKey string
+}
+
+// Verify the base64 encoded signature of the binary at binPath
+func (e *Ed25519) Verify(binPath string, signature []byte) error {
+	pub, err := decodeKey(e.PublicKey, ed25519.PublicKeySize)
+	if err != nil {
+		return fmt.Errorf("invalid public key (%s)", err)
+	}
+	sig, err := decodeKey(string(signature), ed25519.SignatureSize)
+	if err != nil {
+		return fmt.Errorf("invalid signature (%s)", err)
+	}
+	digest, err := digestFile(binPath)
+	if err != nil {
+		return err
+	}
+	opts := &ed25519.Options{Hash: crypto.SHA512}
+	if err := ed25519.VerifyWithOptions(pub, digest, sig, opts); err != nil {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// GenerateKey returns a new base64 encoded key pair
+func GenerateKey() (publicKey, privateKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	enc := base64.StdEncoding
+	return enc.EncodeToString(pub), enc.EncodeToString(priv), nil
+}
+
+// Sign returns the base64 encoded signature of the binary
+// at binPath, using a private key from GenerateKey
+func Sign(privateKey, binPath string) ([]byte, error) {
+	priv, err := decodeKey(privateKey, ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key (%s)", err)
+	}
+	digest, err := digestFile(binPath)
+	if err != nil {
+		return nil, err
+	}
+	opts := &ed25519.Options{Hash: crypto.SHA512}
+	sig, err := ed25519.PrivateKey(priv).Sign(nil, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sig) + "\n"), nil
+}
+
+func decodeKey(s string, size int) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", size, len(b))
+	}
+	return b, nil
+}
+
+func digestFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("read binary (%s)", err)
+	}
+	return h.Sum(nil), nil
+}
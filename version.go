@@ -0,0 +1,143 @@
+package selfup
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// buildVersion returns the module version stamped
+// into this binary by the go tool, if any
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "(devel)" {
+		return ""
+	}
+	return info.Main.Version
+}
+
+// the sanity check of a binary includes its version, so
+// binaries fetched without one are still versioned
+const sanityVersionPrefix = "selfup-version:"
+
+func printSanityVersion(c *Config) {
+	if c.Version != "" {
+		fmt.Fprintf(os.Stdout, "\n%s%s\n", sanityVersionPrefix, c.Version)
+	}
+}
+
+// parseSanityVersion returns the version in the output of a
+// sanity check, which is empty if the binary didn't report one
+func parseSanityVersion(out []byte) string {
+	for _, line := range strings.Split(string(out), "\n") {
+		if v := strings.TrimPrefix(line, sanityVersionPrefix); v != line {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// compareVersions compares two semantic versions, returning -1, 0
+// or +1. A leading "v" and missing minor/patch numbers are allowed.
+// ok is false when either version cannot be parsed.
+func compareVersions(a, b string) (cmp int, ok bool) {
+	va, ok := parseVersion(a)
+	if !ok {
+		return 0, false
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return 0, false
+	}
+	for i := range va.core {
+		if va.core[i] != vb.core[i] {
+			if va.core[i] < vb.core[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return comparePrerelease(va.pre, vb.pre), true
+}
+
+type semver struct {
+	core [3]uint64
+	pre  []string
+}
+
+func parseVersion(s string) (semver, bool) {
+	v := semver{}
+	s = strings.TrimPrefix(s, "v")
+	//build metadata is ignored
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+		for _, id := range v.pre {
+			if id == "" {
+				return v, false
+			}
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return v, false
+		}
+		v.core[i] = n
+	}
+	return v, true
+}
+
+// comparePrerelease follows semver precedence,
+// a version without a prerelease is greater
+func comparePrerelease(a, b []string) int {
+	if len(a) == 0 || len(b) == 0 {
+		switch {
+		case len(a) == len(b):
+			return 0
+		case len(a) == 0:
+			return 1
+		default:
+			return -1
+		}
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		na, errA := strconv.ParseUint(a[i], 10, 64)
+		nb, errB := strconv.ParseUint(b[i], 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if na < nb {
+				return -1
+			}
+			return 1
+		case errA == nil:
+			//numeric identifiers are lower
+			return -1
+		case errB == nil:
+			return 1
+		case a[i] < b[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
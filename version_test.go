@@ -0,0 +1,74 @@
+package selfup
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	//precedence examples of semver 2.0.0 §11, each lower than the next
+	ordered := [][]string{
+		{"1.0.0", "2.0.0", "2.1.0", "2.1.1"},
+		{"1.0.0-alpha", "1.0.0"},
+		{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+			"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0"},
+	}
+	for _, versions := range ordered {
+		for i := range versions {
+			for j := range versions {
+				want := 0
+				if i < j {
+					want = -1
+				} else if i > j {
+					want = 1
+				}
+				cmp, ok := compareVersions(versions[i], versions[j])
+				if !ok || cmp != want {
+					t.Errorf("compareVersions(%q, %q) = %d, %v, want %d", versions[i], versions[j], cmp, ok, want)
+				}
+			}
+		}
+	}
+	tests := []struct {
+		a, b string
+		cmp  int
+		ok   bool
+	}{
+		//a leading v is allowed
+		{"v1.2.3", "1.2.3", 0, true},
+		{"v1.2.3", "v1.10.0", -1, true},
+		//missing minor and patch numbers are zero
+		{"v2", "2.0.0", 0, true},
+		{"1.2", "1.2.1", -1, true},
+		//build metadata is ignored
+		{"1.0.0+build.1", "1.0.0+build.2", 0, true},
+		{"1.0.0-rc.1+build", "1.0.0", -1, true},
+		//numeric identifiers compare numerically, and lower than alphanumeric ones
+		{"1.0.0-2", "1.0.0-10", -1, true},
+		{"1.0.0-10", "1.0.0-a", -1, true},
+		//identifiers compare in ASCII order
+		{"1.0.0-Beta", "1.0.0-alpha", -1, true},
+		{"1.0.0-alpha-2", "1.0.0-alpha-10", 1, true},
+		//unparseable versions
+		{"", "1.0.0", 0, false},
+		{"1.0.0", "latest", 0, false},
+		{"1.0.0.0", "1.0.0", 0, false},
+		{"1.x", "1.0.0", 0, false},
+		{"1.0.0-", "1.0.0", 0, false},
+		{"1.0.0-rc..1", "1.0.0", 0, false},
+	}
+	for _, test := range tests {
+		cmp, ok := compareVersions(test.a, test.b)
+		if cmp != test.cmp || ok != test.ok {
+			t.Errorf("compareVersions(%q, %q) = %d, %v, want %d, %v", test.a, test.b, cmp, ok, test.cmp, test.ok)
+		}
+	}
+}
+
+func TestParseSanityVersion(t *testing.T) {
+	c := &Config{Version: "v1.2.3"}
+	out := "token\n" + sanitySocketsPrefix + "[]\n" + sanityVersionPrefix + c.Version + "\n"
+	if v := parseSanityVersion([]byte(out)); v != c.Version {
+		t.Fatalf("version %q, want %q", v, c.Version)
+	}
+	if v := parseSanityVersion([]byte("token")); v != "" {
+		t.Fatalf("version %q, want none", v)
+	}
+}
@@ -0,0 +1,277 @@
+package selfup
+
+//with Config.Workers the master runs a pool of slave processes
+//sharing the same sockets, restarts replace one worker at a time
+
+import (
+	"os"
+	"time"
+)
+
+// currentWorker returns the process running the
+// given worker, worker 0 is the current slave
+func (mp *master) currentWorker(worker int) *slaveProcess {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	if mp.workers != nil {
+		return mp.workers[worker]
+	}
+	return mp.slave
+}
+
+func (mp *master) setWorker(worker int, s *slaveProcess) {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	mp.workers[worker] = s
+	if worker == 0 {
+		mp.slave = s
+	}
+}
+
+func (mp *master) startWorker(worker int) (*slaveProcess, error) {
+	mp.restartMux.Lock()
+	defer mp.restartMux.Unlock()
+	return mp.startSlave(worker)
+}
+
+// newWorkers creates the pool before the first fetch,
+// the workerLoop starts its workers
+func (mp *master) newWorkers() {
+	mp.workers = make([]*slaveProcess, mp.Workers)
+	mp.shutdown = make(chan bool)
+}
+
+// workersStarted reports whether the workerLoop
+// has started every worker of the pool
+func (mp *master) workersStarted() bool {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	return mp.workers[len(mp.workers)-1] != nil
+}
+
+// workerLoop replaces the forkLoop when there are
+// multiple workers, it exits once they've all stopped
+func (mp *master) workerLoop() error {
+	for i := range mp.workers {
+		s, err := mp.startWorker(i)
+		if err != nil {
+			mp.stopWorkers(os.Kill)
+			return err
+		}
+		mp.setWorker(i, s)
+	}
+	go func() {
+		if mp.ReadyTimeout > 0 {
+			for i := range mp.workers {
+				s := mp.currentWorker(i)
+				select {
+				case <-s.ready:
+				case <-s.done:
+				}
+			}
+		}
+		mp.notifyReady(mp.currentWorker(0))
+	}()
+	codes := make(chan int)
+	for i := range mp.workers {
+		go func(i int) {
+			codes <- mp.superviseWorker(i)
+		}(i)
+	}
+	//proxy the first failure out to the master
+	code := 0
+	for range mp.workers {
+		if c := <-codes; code == 0 {
+			code = c
+		}
+	}
+	mp.exit(code)
+	return nil
+}
+
+// superviseWorker follows the processes running a worker,
+// returning the exit code of the last one once it has stopped
+func (mp *master) superviseWorker(worker int) int {
+	s := mp.currentWorker(worker)
+	for {
+		<-s.done
+		if cur := mp.currentWorker(worker); cur != s {
+			//replaced by a rolling restart
+			s = cur
+			continue
+		}
+		code := exitCode(s.err)
+		mslog.Debug("worker exited", "worker", worker, "slave-id", s.id, "exit-code", code)
+		if s.stopping.Load() || mp.stoppingWorkers() {
+			return code
+		}
+		if !mp.restarting && s.upgrade != nil && mp.rollback(s.upgrade, "exited during probation") {
+			//the other workers are running the failed binary too
+			mslog.Warn("upgraded worker exited during probation, rolled back", "worker", worker, "exit-code", code)
+			go mp.triggerRestart()
+		} else {
+			backoff, ok := mp.crashBackoff(s, code)
+			if !ok {
+				//stop the other workers and exit with this code
+				mp.stopWorkers(SIGTERM)
+				return code
+			}
+			select {
+			case <-time.After(backoff):
+			case <-mp.shutdown:
+				return code
+			}
+			if cur := mp.currentWorker(worker); cur != s {
+				//replaced by a rolling restart while waiting
+				s = cur
+				continue
+			}
+		}
+		next, err := mp.startWorker(worker)
+		if err != nil {
+			mslog.Error("failed to restart worker", "worker", worker, "err", err)
+			mp.stopWorkers(SIGTERM)
+			return 1
+		}
+		mp.setWorker(worker, next)
+		s = next
+	}
+}
+
+// rollingRestart replaces the workers one at a time,
+// so the others keep serving while each one restarts
+func (mp *master) rollingRestart() {
+	if !mp.workersStarted() {
+		mslog.Debug("no worker processes")
+		return //skip
+	}
+	if mp.NoRestart {
+		mp.stopWorkers(mp.Config.RestartSignal)
+		return
+	}
+	mp.restartMux.Lock()
+	if mp.restarting || mp.stoppingWorkers() {
+		mp.restartMux.Unlock()
+		mslog.Debug("already graceful restarting")
+		return
+	}
+	mp.restarting = true
+	mp.restartMux.Unlock()
+	mslog.Debug("rolling restart triggered", "workers", mp.Workers)
+	mp.notify("RELOADING=1", "STATUS=restarting")
+	start := time.Now()
+	done, rolledBack := true, false
+	for i := 0; i < mp.Workers && !mp.stoppingWorkers(); i++ {
+		var ok bool
+		if ok, rolledBack = mp.replaceWorker(i); !ok {
+			done = false
+			break
+		}
+	}
+	mp.restartMux.Lock()
+	mp.restarting = false
+	mp.restartMux.Unlock()
+	if done {
+		mp.metrics.restarted(time.Since(start))
+		mp.statusMux.Lock()
+		mp.restarts++
+		mp.statusMux.Unlock()
+	}
+	mp.notifyReady(mp.currentWorker(0))
+	if rolledBack {
+		//replace workers already running the failed binary
+		go mp.triggerRestart()
+	}
+}
+
+// replaceWorker starts the next process of a worker and then
+// drains the previous one. Returns false if the next process
+// didn't start, and whether the upgrade was rolled back.
+func (mp *master) replaceWorker(worker int) (ok, rolledBack bool) {
+	prev := mp.currentWorker(worker)
+	s, err := mp.startWorker(worker)
+	if err != nil {
+		mslog.Warn("failed to start next worker", "worker", worker, "err", err)
+		return false, false
+	}
+	if mp.ReadyTimeout > 0 {
+		select {
+		case <-s.ready:
+			ok = true
+		case <-s.done:
+			mslog.Warn("next worker exited before becoming ready", "worker", worker, "err", s.err)
+		case <-time.After(mp.ReadyTimeout):
+			mslog.Warn("next worker not ready in time, killing it", "worker", worker, "ready-timeout", mp.ReadyTimeout)
+			s.stopping.Store(true)
+			s.cmd.Process.Kill()
+		}
+		if !ok {
+			rolledBack = s.upgrade != nil && mp.rollback(s.upgrade, "not ready")
+			return false, rolledBack
+		}
+	}
+	mp.setWorker(worker, s)
+	if prev == nil || prev.exited() {
+		return true, false
+	}
+	prev.stopping.Store(true)
+	mp.emit(RestartTriggeredEvent{SlaveID: prev.id, PID: prev.cmd.Process.Pid})
+	prev.cmd.Process.Signal(mp.Config.RestartSignal)
+	select {
+	case <-prev.released:
+	case <-prev.done:
+	case <-time.After(mp.TerminateTimeout):
+		mslog.Debug("graceful timeout, forcing exit", "worker", worker)
+		mp.emit(GracefulTimeoutEvent{SlaveID: prev.id, PID: prev.cmd.Process.Pid, Timeout: mp.TerminateTimeout})
+		prev.cmd.Process.Kill()
+	}
+	return true, false
+}
+
+// signalWorkers proxies a signal to every worker
+func (mp *master) signalWorkers(s os.Signal) {
+	switch s {
+	case os.Interrupt, SIGTERM:
+		mp.notify("STOPPING=1")
+		mp.signalCanary(s)
+		mp.stopWorkers(s)
+	case SIGUSR1:
+		//workers release their sockets over the channel
+	default:
+		for _, w := range mp.liveWorkers() {
+			w.cmd.Process.Signal(s)
+		}
+	}
+}
+
+// stopWorkers asks every worker to stop, they're not restarted
+func (mp *master) stopWorkers(s os.Signal) {
+	mp.shutdownOnce.Do(func() {
+		close(mp.shutdown)
+	})
+	for _, w := range mp.liveWorkers() {
+		w.stopping.Store(true)
+		w.cmd.Process.Signal(s)
+	}
+}
+
+func (mp *master) stoppingWorkers() bool {
+	select {
+	case <-mp.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (mp *master) liveWorkers() []*slaveProcess {
+	mp.statusMux.Lock()
+	defer mp.statusMux.Unlock()
+	live := []*slaveProcess{}
+	for _, w := range mp.workers {
+		if w != nil && !w.exited() {
+			live = append(live, w)
+		}
+	}
+	return live
+}